@@ -0,0 +1,138 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
+	"strings"
+)
+
+// rows written to the database at a time by a bulkWriter
+const bulkBatchSize = 10000
+
+// A bulkWriter appends rows to a table in batches. postgresql gets each batch through COPY,
+// sqlite through a prepared insert, and either way a batch is committed before the next one
+// is started.
+type bulkWriter struct {
+	ctx     context.Context
+	db      *sql.DB
+	table   string
+	columns []string
+	rows    [][]interface{}
+	count   int
+}
+
+func newBulkWriter(ctx context.Context, db *sql.DB, table string, columns ...string) *bulkWriter {
+	return &bulkWriter{ctx: ctx, db: db, table: table, columns: columns,
+		rows: make([][]interface{}, 0, bulkBatchSize)}
+}
+
+// add buffers a row, with a value for each of the writer's columns, and writes the batch once
+// it's full.
+func (w *bulkWriter) add(values ...interface{}) (err error) {
+	if len(values) != len(w.columns) {
+		panic(fmt.Sprintf("%d values for the %d columns of %s", len(values), len(w.columns), w.table))
+	}
+	w.rows = append(w.rows, values)
+	if len(w.rows) >= bulkBatchSize {
+		err = w.flush()
+	}
+	return
+}
+
+// flush writes the buffered rows.
+func (w *bulkWriter) flush() (err error) {
+	if len(w.rows) == 0 {
+		return
+	}
+
+	if isSQLite() {
+		err = w.insertRows()
+	} else {
+		err = w.copyRows()
+	}
+	if err != nil {
+		return
+	}
+
+	w.count += len(w.rows)
+	w.rows = w.rows[:0]
+	return
+}
+
+// close writes whatever rows are still buffered, and returns how many were written in all.
+func (w *bulkWriter) close() (count int, err error) {
+	err = w.flush()
+	count = w.count
+	return
+}
+
+func (w *bulkWriter) copyRows() (err error) {
+	ctx := w.ctx
+
+	conn, err := w.db.Conn(ctx)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	err = conn.Raw(func(driverConn interface{}) (err error) {
+		pgxConn := driverConn.(*stdlib.Conn).Conn()
+		_, err = pgxConn.CopyFrom(ctx, pgx.Identifier{w.table}, w.columns, pgx.CopyFromRows(w.rows))
+		return
+	})
+	return
+}
+
+func (w *bulkWriter) insertRows() (err error) {
+	placeholders := make([]string, 0)
+	for i := range w.columns {
+		placeholders = append(placeholders, fmt.Sprintf("$%d", i+1))
+	}
+	s := "INSERT INTO " + w.table + " (" + strings.Join(w.columns, ", ") + ") " +
+		"VALUES (" + strings.Join(placeholders, ", ") + ")"
+
+	trans, err := w.db.BeginTx(w.ctx, nil)
+	if err != nil {
+		return
+	}
+
+	stmt, err := trans.PrepareContext(w.ctx, s)
+	if err != nil {
+		trans.Rollback()
+		return
+	}
+	defer stmt.Close()
+
+	for _, values := range w.rows {
+		_, err = stmt.ExecContext(w.ctx, values...)
+		if err != nil {
+			trans.Rollback()
+			return
+		}
+	}
+
+	err = trans.Commit()
+	return
+}
+
+// deleteAll empties the tables, in the order given, in a single transaction.
+func deleteAll(ctx context.Context, db *sql.DB, deletes ...func(*sql.Tx) error) (err error) {
+	trans, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+
+	for _, deleteRows := range deletes {
+		err = deleteRows(trans)
+		if err != nil {
+			trans.Rollback()
+			return
+		}
+	}
+
+	err = trans.Commit()
+	return
+}
@@ -0,0 +1,150 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// productViewsQuery returns the SQL for the views of every product, summed over everyone and
+// counting view events.
+func productViewsQuery() string {
+	return "SELECT account_id, pid, SUM(count) AS views FROM " +
+		interactionsQuery("user_product_views", ViewEvent) + " u GROUP BY account_id, pid"
+}
+
+// productPurchasesQuery returns the SQL for the purchases of every product, summed over
+// everyone and counting purchase events.
+func productPurchasesQuery() string {
+	return "SELECT account_id, pid, SUM(count) AS purchases FROM " +
+		interactionsQuery("user_product_purchases", PurchaseEvent) + " u GROUP BY account_id, pid"
+}
+
+// insertSmoothedConversionRates computes the conversion rate of every viewed product as its
+// purchases over its views, smoothed toward the account's overall rate as if each product had
+// another priorViews views converting at that rate. A product with a handful of views stays
+// close to the account's rate, one with thousands keeps its own. Like the loaded rates it's
+// units purchased over views, so it isn't capped at 1.
+func insertSmoothedConversionRates(ctx context.Context, trans *sql.Tx,
+	priorViews float64) (err error) {
+
+	s := []string{}
+
+	s = append(s, "INSERT INTO product_conversion_rate (account_id, pid, conversion_rate)")
+	s = append(s, "WITH views AS ("+productViewsQuery()+"),")
+	s = append(s, "purchases AS ("+productPurchasesQuery()+")")
+	s = append(s, "SELECT v.account_id, v.pid,")
+	s = append(s, "(COALESCE(pu.purchases, 0) + $1 * a.rate) / (v.views + $1)")
+	s = append(s, "FROM views v")
+	s = append(s, "LEFT JOIN purchases pu ON (")
+	s = append(s, "pu.account_id = v.account_id AND pu.pid = v.pid)")
+	s = append(s, "JOIN (")
+	s = append(s, "SELECT av.account_id,")
+	s = append(s, "CAST(SUM(COALESCE(apu.purchases, 0)) AS FLOAT) / SUM(av.views) AS rate")
+	s = append(s, "FROM views av")
+	s = append(s, "LEFT JOIN purchases apu ON (")
+	s = append(s, "apu.account_id = av.account_id AND apu.pid = av.pid)")
+	s = append(s, "GROUP BY av.account_id) a ON (a.account_id = v.account_id)")
+	s = append(s, "WHERE v.views > 0")
+
+	query := strings.Join(s, " ")
+
+	_, err = trans.ExecContext(ctx, query, priorViews)
+	return
+}
+
+// insertConversionRateBuilds records that every account with a conversion rate had them
+// computed, with the prior.
+func insertConversionRateBuilds(ctx context.Context, trans *sql.Tx,
+	priorViews float64) (err error) {
+
+	rows, err := trans.QueryContext(ctx, "SELECT DISTINCT account_id FROM product_conversion_rate")
+	if err != nil {
+		return
+	}
+	accountIds := make([]int64, 0)
+	for rows.Next() {
+		var accountId int64
+		err = rows.Scan(&accountId)
+		if err != nil {
+			rows.Close()
+			return
+		}
+		accountIds = append(accountIds, accountId)
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return
+	}
+
+	builtAt := time.Now()
+	for _, accountId := range accountIds {
+		_, err = trans.ExecContext(ctx, "INSERT INTO product_conversion_rate_build "+
+			"(account_id, prior_views, built_at) VALUES ($1, $2, $3)", accountId, priorViews,
+			builtAt)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// QueryConversionRatePrior returns the prior the account's conversion rates were computed
+// with, and false if they were loaded rather than computed.
+func QueryConversionRatePrior(ctx context.Context, db *sql.DB,
+	accountId int64) (priorViews float64, built bool, err error) {
+
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	row := db.QueryRowContext(ctx, "SELECT prior_views FROM product_conversion_rate_build "+
+		"WHERE account_id = $1", accountId)
+	err = row.Scan(&priorViews)
+	if err == sql.ErrNoRows {
+		err = nil
+		return
+	}
+	built = err == nil
+	return
+}
+
+// BuildProductConversionRates replaces the conversion rates with ones computed from the
+// currently loaded views and purchases, rather than the ones from the hive job. Nothing
+// changes if it fails or is cancelled.
+func BuildProductConversionRates(ctx context.Context, db *sql.DB, priorViews float64) (err error) {
+	fmt.Println("building product conversion rates")
+
+	trans, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+
+	err = deleteAllProductConversionRates(trans)
+	if err != nil {
+		trans.Rollback()
+		return
+	}
+
+	err = insertSmoothedConversionRates(ctx, trans, priorViews)
+	if err != nil {
+		trans.Rollback()
+		return
+	}
+
+	err = insertConversionRateBuilds(ctx, trans, priorViews)
+	if err != nil {
+		trans.Rollback()
+		return
+	}
+
+	err = trans.Commit()
+	if err != nil {
+		return
+	}
+
+	fmt.Println("product conversion rates done")
+	return
+}
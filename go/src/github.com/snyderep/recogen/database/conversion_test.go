@@ -0,0 +1,57 @@
+package database
+
+import (
+	"context"
+	"math"
+	"testing"
+)
+
+func TestBuildProductConversionRatesSmoothing(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t, true)
+	// 20 units bought over 10 views of a and none over 90 views of b, 0.2 over the account
+	testExec(t, db, "INSERT INTO user_product_views (account_id, monetate_id, pid, count) "+
+		"VALUES ($1, 'x', 'a', 10), ($1, 'x', 'b', 90), (1, 'x', 'a', 5)", testAccountId)
+	testExec(t, db, "INSERT INTO user_product_purchases (account_id, monetate_id, pid, count) "+
+		"VALUES ($1, 'x', 'a', 20), (1, 'x', 'a', 5)", testAccountId)
+
+	tests := []struct {
+		priorViews float64
+		a          float64
+		b          float64
+	}{
+		{0, 2.0, 0.0},
+		{10, 22.0 / 20.0, 2.0 / 100.0},
+		{100, 40.0 / 110.0, 20.0 / 190.0},
+		{1e9, 0.2, 0.2},
+	}
+
+	for _, test := range tests {
+		err := BuildProductConversionRates(ctx, db, test.priorViews)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for pid, want := range map[string]float64{"a": test.a, "b": test.b} {
+			var rate float64
+			err = db.QueryRow("SELECT conversion_rate FROM product_conversion_rate "+
+				"WHERE account_id = $1 AND pid = $2", testAccountId, pid).Scan(&rate)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if math.Abs(rate-want) > 1e-6 {
+				t.Errorf("prior %g: %s converts at %f, want %f", test.priorViews, pid, rate, want)
+			}
+		}
+		// the other account converts at 1.0 and doesn't pull this one's rates toward it
+		var rate float64
+		err = db.QueryRow("SELECT conversion_rate FROM product_conversion_rate " +
+			"WHERE account_id = 1 AND pid = 'a'").Scan(&rate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if math.Abs(rate-1.0) > 1e-6 {
+			t.Errorf("prior %g: the other account's a converts at %f, want 1", test.priorViews,
+				rate)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+func deleteAllProductCoOccurrences(trans *sql.Tx) (err error) {
+	_, err = trans.Exec("DELETE FROM product_cooccurrence")
+	return
+}
+
+// insertProductCoOccurrences counts, for every pair of products, how many people interacted
+// with both in the given table or by the events of the given type, along with the pair's
+// Jaccard similarity and lift.
+func insertProductCoOccurrences(ctx context.Context, trans *sql.Tx, source string,
+	table string, eventType string) (err error) {
+
+	s := []string{}
+
+	s = append(s, "INSERT INTO product_cooccurrence (account_id, source, pid, other_pid, count,")
+	s = append(s, "jaccard, lift)")
+	s = append(s, "WITH interactions AS "+interactionsQuery(table, eventType))
+	s = append(s, "SELECT pairs.account_id, CAST($1 AS TEXT), pairs.pid, pairs.other_pid, pairs.count,")
+	s = append(s, "CAST(pairs.count AS FLOAT) / (a.people + b.people - pairs.count),")
+	s = append(s, "CAST(pairs.count AS FLOAT) * t.people / (a.people * b.people)")
+	s = append(s, "FROM (")
+	s = append(s, "SELECT x.account_id, x.pid, y.pid AS other_pid, COUNT(*) AS count")
+	s = append(s, "FROM interactions x JOIN interactions y ON (")
+	s = append(s, "x.account_id = y.account_id AND")
+	s = append(s, "x.monetate_id = y.monetate_id AND")
+	s = append(s, "x.pid <> y.pid)")
+	s = append(s, "GROUP BY x.account_id, x.pid, y.pid) pairs")
+	s = append(s, "JOIN (")
+	s = append(s, "SELECT account_id, pid, COUNT(*) AS people FROM interactions")
+	s = append(s, "GROUP BY account_id, pid) a ON (")
+	s = append(s, "a.account_id = pairs.account_id AND a.pid = pairs.pid)")
+	s = append(s, "JOIN (")
+	s = append(s, "SELECT account_id, pid, COUNT(*) AS people FROM interactions")
+	s = append(s, "GROUP BY account_id, pid) b ON (")
+	s = append(s, "b.account_id = pairs.account_id AND b.pid = pairs.other_pid)")
+	s = append(s, "JOIN (")
+	s = append(s, "SELECT account_id, COUNT(DISTINCT monetate_id) AS people FROM interactions")
+	s = append(s, "GROUP BY account_id) t ON (t.account_id = pairs.account_id)")
+
+	query := strings.Join(s, " ")
+
+	_, err = trans.ExecContext(ctx, query, source)
+	return
+}
+
+// BuildProductCoOccurrences replaces the co-occurrence table with one computed from the
+// currently loaded views and purchases, events included. Nothing changes if it fails or is cancelled.
+func BuildProductCoOccurrences(ctx context.Context, db *sql.DB) (err error) {
+	fmt.Println("building product co-occurrences")
+
+	trans, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+
+	err = deleteAllProductCoOccurrences(trans)
+	if err != nil {
+		trans.Rollback()
+		return
+	}
+
+	err = insertProductCoOccurrences(ctx, trans, "view", "user_product_views", ViewEvent)
+	if err != nil {
+		trans.Rollback()
+		return
+	}
+	err = insertProductCoOccurrences(ctx, trans, "purchase", "user_product_purchases",
+		PurchaseEvent)
+	if err != nil {
+		trans.Rollback()
+		return
+	}
+
+	err = trans.Commit()
+	if err != nil {
+		return
+	}
+
+	fmt.Println("product co-occurrences done")
+	return
+}
+
+type Neighbour struct {
+	Product *Product
+	Weight  float64
+}
+
+// QueryProductNeighbours returns the products that co-occur with the product, weighted by
+// their Jaccard similarity summed over views and purchases, heaviest first.
+func QueryProductNeighbours(ctx context.Context, db *sql.DB, accountId int64, product *Product,
+	limit int) (neighbours []*Neighbour, err error) {
+
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	s := []string{}
+
+	s = append(s, "SELECT")
+	s = append(s, "p.account_id, p.pid, p.name, p.product_url, p.image_url, p.unit_cost,")
+	s = append(s, "p.unit_price, p.margin, p.margin_rate,")
+	s = append(s, "COALESCE(pc.category_id, ''), COALESCE(pc.category_name, ''),")
+	s = append(s, "n.weight")
+	s = append(s, "FROM product p JOIN (")
+	s = append(s, "SELECT other_pid, SUM(jaccard) AS weight")
+	s = append(s, "FROM product_cooccurrence")
+	s = append(s, "WHERE account_id = $1 AND pid = $2")
+	s = append(s, "GROUP BY other_pid) n ON (p.pid = n.other_pid)")
+	s = append(s, "LEFT JOIN product_category pc ON (p.account_id = pc.account_id AND p.pid = pc.pid)")
+	s = append(s, "WHERE p.account_id = $1")
+	s = append(s, "ORDER BY n.weight DESC, p.pid")
+	s = append(s, "LIMIT $3")
+
+	query := strings.Join(s, " ")
+
+	rows, err := db.QueryContext(ctx, query, accountId, product.Pid, limit)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	neighbours = make([]*Neighbour, 0)
+
+	for rows.Next() {
+		n := &Neighbour{Product: &Product{}}
+		p := n.Product
+		err = rows.Scan(&p.AccountId, &p.Pid, &p.Name, &p.ProductUrl, &p.ImageUrl, &p.UnitCost,
+			&p.UnitPrice, &p.Margin, &p.MarginRate, &p.CategoryId, &p.CategoryName, &n.Weight)
+		if err != nil {
+			return
+		}
+		neighbours = append(neighbours, n)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return
+	}
+
+	return
+}
@@ -1,15 +1,22 @@
 package database
 
 import (
+	"context"
 	"database/sql"
-	_ "github.com/bmizerany/pq"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
 	"strings"
+	"time"
 )
 
 func deleteAllProducts(trans *sql.Tx) (err error) {
 	_, err = trans.Exec("DELETE FROM product")
 	return
 }
+func deleteAllProductCategories(trans *sql.Tx) (err error) {
+	_, err = trans.Exec("DELETE FROM product_category")
+	return
+}
 func deleteAllUserProductViews(trans *sql.Tx) (err error) {
 	_, err = trans.Exec("DELETE FROM user_product_views")
 	return
@@ -20,224 +27,274 @@ func deleteAllUserProductPurchases(trans *sql.Tx) (err error) {
 }
 func deleteAllProductConversionRates(trans *sql.Tx) (err error) {
 	_, err = trans.Exec("DELETE FROM product_conversion_rate")
-	return
-}
-
-func getInsertProductStmt(trans *sql.Tx) (stmt *sql.Stmt) {
-	// note that postgresql uses $1, $2, etc while others use ?
-	s := "INSERT INTO product (account_id, pid, name, product_url, image_url, unit_cost, " +
-		"unit_price, margin, margin_rate) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)"
-	var err error
-	stmt, err = trans.Prepare(s)
-	if err != nil {
-		panic(err)
-	}
-	return
-}
-func getInsertUserProductViewStmt(trans *sql.Tx) (stmt *sql.Stmt) {
-	// note that postgresql uses $1, $2, etc while others use ?
-	s := "INSERT INTO user_product_views (account_id, monetate_id, pid, count) " +
-		"VALUES ($1, $2, $3, $4)"
-	var err error
-	stmt, err = trans.Prepare(s)
-	if err != nil {
-		panic(err)
-	}
-	return
-}
-func getInsertUserProductPurchaseStmt(trans *sql.Tx) (stmt *sql.Stmt) {
-	// note that postgresql uses $1, $2, etc while others use ?
-	s := "INSERT INTO user_product_purchases (account_id, monetate_id, pid, count) " +
-		"VALUES ($1, $2, $3, $4)"
-	var err error
-	stmt, err = trans.Prepare(s)
 	if err != nil {
-		panic(err)
+		return
 	}
+	_, err = trans.Exec("DELETE FROM product_conversion_rate_build")
 	return
 }
-func getInsertProductConversionRateStmt(trans *sql.Tx) (stmt *sql.Stmt) {
-	// note that postgresql uses $1, $2, etc while others use ?
-	s := "INSERT INTO product_conversion_rate (account_id, pid, conversion_rate) " +
-		"VALUES ($1, $2, $3)"
-	var err error
-	stmt, err = trans.Prepare(s)
-	if err != nil {
-		panic(err)
+
+// interactionsQuery returns the SQL for a table of everyone's views or purchases with the
+// events of the same type counted in, one row per person and product, so that people whose
+// interactions only came as events aren't missed. Events are dated to the day, like the table.
+func interactionsQuery(table string, eventType string) string {
+	eventDay := "CAST(event_time AS DATE)"
+	if isSQLite() {
+		eventDay = "date(event_time)"
 	}
-	return
-}
 
-func insertProduct(stmt *sql.Stmt, p *Product) (err error) {
-	_, err = stmt.Exec(p.AccountId, p.Pid, p.Name, p.ProductUrl, p.ImageUrl,
-		p.UnitCost, p.UnitPrice, p.Margin, p.MarginRate)
-	return
+	s := []string{}
+
+	s = append(s, "(SELECT account_id, monetate_id, pid, SUM(count) AS count, MAX(last_dt) AS last_dt")
+	s = append(s, "FROM (")
+	s = append(s, "SELECT account_id, monetate_id, pid, count, last_dt FROM "+table)
+	s = append(s, "UNION ALL")
+	s = append(s, "SELECT account_id, monetate_id, pid, 1, "+eventDay+" FROM user_product_event")
+	s = append(s, "WHERE event_type = '"+eventType+"') i")
+	s = append(s, "GROUP BY account_id, monetate_id, pid)")
+
+	return strings.Join(s, " ")
 }
-func insertUserProduct(stmt *sql.Stmt, accountId int64, monetateId string, pid string,
-	count int64) (err error) {
 
-	_, err = stmt.Exec(accountId, monetateId, pid, count)
-	return
+// interactedQuery returns the SQL for the columns of the rows of the table, and of the
+// events of the same type, that meet the condition. Unlike interactionsQuery nothing is summed,
+// so the condition is applied to each table on its own and their indexes can be used. The
+// columns and the condition can only use the columns the two have in common.
+func interactedQuery(table string, eventType string, columns string, condition string) string {
+	s := []string{}
+
+	s = append(s, "SELECT "+columns+" FROM "+table+" WHERE "+condition)
+	s = append(s, "UNION")
+	s = append(s, "SELECT "+columns+" FROM user_product_event")
+	s = append(s, "WHERE event_type = '"+eventType+"' AND "+condition)
+
+	return strings.Join(s, " ")
 }
-func insertProductConversionRate(stmt *sql.Stmt, accountId int64, pid string,
-	conversionRate float64) (err error) {
 
-	_, err = stmt.Exec(accountId, pid, conversionRate)
-	return
+// personPidsQuery returns the SQL for the pids the person, $2 in account $1, viewed or
+// purchased, events included.
+func personPidsQuery() string {
+	mine := "account_id = $1 AND monetate_id = $2"
+	return interactedQuery("user_product_views", ViewEvent, "pid", mine) + " UNION " +
+		interactedQuery("user_product_purchases", PurchaseEvent, "pid", mine)
 }
 
-func QueryPeopleThatViewedProducts(db *sql.DB, accountId int64, products map[string]*Product) (people []*Person) {
+func QueryPeopleThatViewedProducts(ctx context.Context, db *sql.DB, accountId int64,
+	products map[string]*Product, decay *Decay) (people []*Person, err error) {
+
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
 	s := []string{}
 
-	s = append(s, "SELECT DISTINCT monetate_id")
-	s = append(s, "FROM user_product_views")
-	s = append(s, "WHERE account_id = $1 AND pid = $2")
-	s = append(s, "AND RANDOM() < 0.01")
+	// weighted random sampling without replacement, people that viewed the product more
+	// often, and more recently, are more likely to be chosen
+	s = append(s, "SELECT u.monetate_id")
+	s = append(s, "FROM "+interactionsQuery("user_product_views", ViewEvent)+" u")
+	s = append(s, "WHERE u.account_id = $1 AND u.pid = $2 AND u.count > 0")
+	s = append(s, "ORDER BY -LN(1.0 - RANDOM()) / ("+decay.weight("u")+")")
 	s = append(s, "LIMIT 2")
 
 	query := strings.Join(s, " ")
 
-	stmt, err := db.Prepare(query)
-	defer stmt.Close()
+	stmt, err := db.PrepareContext(ctx, query)
 	if err != nil {
-		panic(err)
+		return
 	}
+	defer stmt.Close()
 
 	people = make([]*Person, 0)
 
 	for pid, _ := range products {
-		rows, err := stmt.Query(accountId, pid)
+		var rows *sql.Rows
+		rows, err = stmt.QueryContext(ctx, accountId, pid)
 		if err != nil {
-			panic(err)
+			return
 		}
 
 		for rows.Next() {
 			p := &Person{}
 			err = rows.Scan(&p.MonetateId)
 			if err != nil {
-				panic(err)
+				rows.Close()
+				return
 			}
 			people = append(people, p)
 		}
 
 		err = rows.Err()
 		if err != nil {
-			panic(err)
+			return
 		}
 	}
 
 	return
 }
 
-func QueryProductsViewedByPeople(db *sql.DB, accountId int64, people map[string]*Person) (products []*Product) {
+func QueryProductsViewedByPeople(ctx context.Context, db *sql.DB, accountId int64,
+	people map[string]*Person) (products []*Product, err error) {
+
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
 	s := []string{}
 
 	s = append(s, "SELECT")
 	s = append(s, "p.account_id, p.pid, p.name, p.product_url, p.image_url, p.unit_cost,")
-	s = append(s, "p.unit_price, p.margin, p.margin_rate")
-	s = append(s, "FROM user_product_views u JOIN product p ON (")
+	s = append(s, "p.unit_price, p.margin, p.margin_rate,")
+	s = append(s, "COALESCE(pc.category_id, ''), COALESCE(pc.category_name, '')")
+	s = append(s, "FROM "+interactionsQuery("user_product_views", ViewEvent)+" u JOIN product p ON (")
 	s = append(s, "u.account_id = p.account_id AND")
 	s = append(s, "u.pid = p.pid)")
+	s = append(s, "LEFT JOIN product_category pc ON (p.account_id = pc.account_id AND p.pid = pc.pid)")
 	s = append(s, "WHERE u.account_id = $1 AND u.monetate_id = $2")
 
 	query := strings.Join(s, " ")
 
-	stmt, err := db.Prepare(query)
-	defer stmt.Close()
+	stmt, err := db.PrepareContext(ctx, query)
 	if err != nil {
-		panic(err)
+		return
 	}
+	defer stmt.Close()
 
 	products = make([]*Product, 0)
 
 	for pid, _ := range people {
-		rows, err := stmt.Query(accountId, pid)
+		var rows *sql.Rows
+		rows, err = stmt.QueryContext(ctx, accountId, pid)
 		if err != nil {
-			panic(err)
+			return
 		}
 
 		for rows.Next() {
 			p := &Product{}
 			err = rows.Scan(&p.AccountId, &p.Pid, &p.Name, &p.ProductUrl, &p.ImageUrl, &p.UnitCost,
-				&p.UnitPrice, &p.Margin, &p.MarginRate)
+				&p.UnitPrice, &p.Margin, &p.MarginRate, &p.CategoryId, &p.CategoryName)
 			if err != nil {
-				panic(err)
+				rows.Close()
+				return
 			}
 			products = append(products, p)
 		}
 
 		err = rows.Err()
 		if err != nil {
-			panic(err)
+			return
 		}
 	}
 
 	return
 }
 
-func QueryProductsViewed(db *sql.DB, accountId int64, person *Person) (products []*Product) {
+func QueryProductsViewed(ctx context.Context, db *sql.DB, accountId int64,
+	person *Person) (products []*Product, err error) {
+
 	people := make(map[string]*Person)
 	people[person.MonetateId] = person
-	products = QueryProductsViewedByPeople(db, accountId, people)
+	products, err = QueryProductsViewedByPeople(ctx, db, accountId, people)
 	return
 }
 
-func QueryProductsPurchasedByPeople(db *sql.DB, accountId int64, people map[string]*Person) (products []*Product) {
+func QueryProductsPurchasedByPeople(ctx context.Context, db *sql.DB, accountId int64,
+	people map[string]*Person) (products []*Product, err error) {
+
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
 	s := []string{}
 
 	s = append(s, "SELECT")
 	s = append(s, "p.account_id, p.pid, p.name, p.product_url, p.image_url, p.unit_cost,")
-	s = append(s, "p.unit_price, p.margin, p.margin_rate")
-	s = append(s, "FROM user_product_purchases u JOIN product p ON (")
+	s = append(s, "p.unit_price, p.margin, p.margin_rate,")
+	s = append(s, "COALESCE(pc.category_id, ''), COALESCE(pc.category_name, '')")
+	s = append(s, "FROM "+interactionsQuery("user_product_purchases", PurchaseEvent)+" u JOIN product p ON (")
 	s = append(s, "u.account_id = p.account_id AND")
 	s = append(s, "u.pid = p.pid)")
+	s = append(s, "LEFT JOIN product_category pc ON (p.account_id = pc.account_id AND p.pid = pc.pid)")
 	s = append(s, "WHERE u.account_id = $1 AND u.monetate_id = $2")
 
 	query := strings.Join(s, " ")
 
-	stmt, err := db.Prepare(query)
-	defer stmt.Close()
+	stmt, err := db.PrepareContext(ctx, query)
 	if err != nil {
-		panic(err)
+		return
 	}
+	defer stmt.Close()
 
 	products = make([]*Product, 0)
 
 	for pid, _ := range people {
-		rows, err := stmt.Query(accountId, pid)
+		var rows *sql.Rows
+		rows, err = stmt.QueryContext(ctx, accountId, pid)
 		if err != nil {
-			panic(err)
+			return
 		}
 
 		for rows.Next() {
 			p := &Product{}
 			err = rows.Scan(&p.AccountId, &p.Pid, &p.Name, &p.ProductUrl, &p.ImageUrl, &p.UnitCost,
-				&p.UnitPrice, &p.Margin, &p.MarginRate)
+				&p.UnitPrice, &p.Margin, &p.MarginRate, &p.CategoryId, &p.CategoryName)
 			if err != nil {
-				panic(err)
+				rows.Close()
+				return
 			}
 			products = append(products, p)
 		}
 
 		err = rows.Err()
 		if err != nil {
-			panic(err)
+			return
 		}
 	}
 
 	return
 }
 
-func QueryProductsPurchased(db *sql.DB, accountId int64, person *Person) (products []*Product) {
+func QueryProductsPurchased(ctx context.Context, db *sql.DB, accountId int64,
+	person *Person) (products []*Product, err error) {
+
 	people := make(map[string]*Person)
 	people[person.MonetateId] = person
-	products = QueryProductsPurchasedByPeople(db, accountId, people)
+	products, err = QueryProductsPurchasedByPeople(ctx, db, accountId, people)
+	return
+}
+
+// QuerySampledProductsViewed returns up to limit of the products the person viewed, chosen at
+// random but weighted by how many times, and how recently, the person viewed each one.
+func QuerySampledProductsViewed(ctx context.Context, db *sql.DB, accountId int64, person *Person,
+	limit int, decay *Decay) (products []*Product, err error) {
+
+	s := []string{}
+
+	s = append(s, "SELECT")
+	s = append(s, "p.account_id, p.pid, p.name, p.product_url, p.image_url, p.unit_cost,")
+	s = append(s, "p.unit_price, p.margin, p.margin_rate,")
+	s = append(s, "COALESCE(pc.category_id, ''), COALESCE(pc.category_name, '')")
+	s = append(s, "FROM "+interactionsQuery("user_product_views", ViewEvent)+" u JOIN product p ON (")
+	s = append(s, "u.account_id = p.account_id AND")
+	s = append(s, "u.pid = p.pid)")
+	s = append(s, "LEFT JOIN product_category pc ON (p.account_id = pc.account_id AND p.pid = pc.pid)")
+	s = append(s, "WHERE u.account_id = $1 AND u.monetate_id = $2 AND u.count > 0")
+	s = append(s, "ORDER BY -LN(1.0 - RANDOM()) / ("+decay.weight("u")+")")
+	s = append(s, "LIMIT $3")
+
+	query := strings.Join(s, " ")
+
+	products, err = queryProducts(ctx, db, query, accountId, person.MonetateId, limit)
 	return
 }
 
-func QueryProductsViewedAndPurchased(db *sql.DB, accountId int64, person *Person) (allProducts []*Product) {
-	products := QueryProductsViewed(db, accountId, person)
-	purchProducts := QueryProductsPurchased(db, accountId, person)
+func QueryProductsViewedAndPurchased(ctx context.Context, db *sql.DB, accountId int64,
+	person *Person) (allProducts []*Product, err error) {
+
+	products, err := QueryProductsViewed(ctx, db, accountId, person)
+	if err != nil {
+		return
+	}
+	purchProducts, err := QueryProductsPurchased(ctx, db, accountId, person)
+	if err != nil {
+		return
+	}
 
 	// concatenate the slices, no there's no convenient way to do this
 	allProducts = make([]*Product, len(products)+len(purchProducts))
@@ -247,117 +304,222 @@ func QueryProductsViewedAndPurchased(db *sql.DB, accountId int64, person *Person
 	return
 }
 
-func QueryRandomProduct(db *sql.DB, accountId int64, person *Person) (product *Product) {
+// QueryRandomProduct returns a product chosen at random, nil only if the account has no
+// products. A large catalog is sampled cheaply, about 1% of it, and the whole catalog is only
+// shuffled when the sample comes back empty.
+func QueryRandomProduct(ctx context.Context, db *sql.DB, accountId int64,
+	person *Person) (product *Product, err error) {
+
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	for _, sample := range []string{"AND RANDOM() < 0.01", "ORDER BY RANDOM()"} {
+		s := []string{}
+
+		s = append(s, "SELECT")
+		s = append(s, "p.account_id, p.pid, p.name, p.product_url, p.image_url, p.unit_cost,")
+		s = append(s, "p.unit_price, p.margin, p.margin_rate,")
+		s = append(s, "COALESCE(pc.category_id, ''), COALESCE(pc.category_name, '')")
+		s = append(s, "FROM product p")
+		s = append(s, "LEFT JOIN product_category pc ON (p.account_id = pc.account_id AND p.pid = pc.pid)")
+		s = append(s, "WHERE p.account_id = $1")
+		s = append(s, sample)
+		s = append(s, "LIMIT 1")
+
+		query := strings.Join(s, " ")
+
+		row := db.QueryRowContext(ctx, query, accountId)
+		product = &Product{}
+		err = row.Scan(&product.AccountId, &product.Pid, &product.Name, &product.ProductUrl,
+			&product.ImageUrl, &product.UnitCost, &product.UnitPrice, &product.Margin,
+			&product.MarginRate, &product.CategoryId, &product.CategoryName)
+		if err != sql.ErrNoRows {
+			return
+		}
+	}
+
+	product = nil
+	err = nil
+	return
+}
+
+func QuerySoundAlikeProduct(ctx context.Context, db *sql.DB, accountId int64,
+	inProduct *Product) (product *Product, err error) {
+
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
 	s := []string{}
 
 	s = append(s, "SELECT")
-	s = append(s, "account_id, pid, name, product_url, image_url, unit_cost,")
-	s = append(s, "unit_price, margin, margin_rate")
-	s = append(s, "FROM product")
-	s = append(s, "WHERE account_id = $1")
-	s = append(s, "AND RANDOM() < 0.01")
+	s = append(s, "p.account_id, p.pid, p.name, p.product_url, p.image_url, p.unit_cost,")
+	s = append(s, "p.unit_price, p.margin, p.margin_rate,")
+	s = append(s, "COALESCE(pc.category_id, ''), COALESCE(pc.category_name, '')")
+	s = append(s, "FROM product p")
+	s = append(s, "LEFT JOIN product_category pc ON (p.account_id = pc.account_id AND p.pid = pc.pid)")
+	s = append(s, "WHERE p.account_id = $1")
+	s = append(s, "AND difference(p.name, $2) >= 3")
 	s = append(s, "LIMIT 1")
 
 	query := strings.Join(s, " ")
 
-	row := db.QueryRow(query, accountId)
+	row := db.QueryRowContext(ctx, query, accountId, inProduct.Name)
 	product = &Product{}
-	err := row.Scan(&product.AccountId, &product.Pid, &product.Name, &product.ProductUrl, &product.ImageUrl,
-		&product.UnitCost, &product.UnitPrice, &product.Margin, &product.MarginRate)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			product = nil
-		} else {
-			panic(err)
-		}
+	err = row.Scan(&product.AccountId, &product.Pid, &product.Name, &product.ProductUrl, &product.ImageUrl,
+		&product.UnitCost, &product.UnitPrice, &product.Margin, &product.MarginRate,
+		&product.CategoryId, &product.CategoryName)
+	if err == sql.ErrNoRows {
+		product = nil
+		err = nil
 	}
 
 	return
 }
 
-func QuerySoundAlikeProduct(db *sql.DB, accountId int64, inProduct *Product) (product *Product) {
+// QueryRandomProductInCategory returns a random product from the category other than the
+// given pid, or nil if there isn't one.
+func QueryRandomProductInCategory(ctx context.Context, db *sql.DB, accountId int64,
+	categoryId string, pid string) (product *Product, err error) {
+
 	s := []string{}
 
 	s = append(s, "SELECT")
-	s = append(s, "account_id, pid, name, product_url, image_url, unit_cost,")
-	s = append(s, "unit_price, margin, margin_rate")
-	s = append(s, "FROM product")
-	s = append(s, "WHERE account_id = $1")
-	s = append(s, "AND difference(name, $2) >= 3")
+	s = append(s, "p.account_id, p.pid, p.name, p.product_url, p.image_url, p.unit_cost,")
+	s = append(s, "p.unit_price, p.margin, p.margin_rate,")
+	s = append(s, "COALESCE(pc.category_id, ''), COALESCE(pc.category_name, '')")
+	s = append(s, "FROM product p")
+	s = append(s, "JOIN product_category pc ON (p.account_id = pc.account_id AND p.pid = pc.pid)")
+	s = append(s, "WHERE p.account_id = $1 AND pc.category_id = $2 AND p.pid <> $3")
+	s = append(s, "ORDER BY RANDOM()")
 	s = append(s, "LIMIT 1")
 
 	query := strings.Join(s, " ")
 
-	row := db.QueryRow(query, accountId, inProduct.Name)
-	product = &Product{}
-	err := row.Scan(&product.AccountId, &product.Pid, &product.Name, &product.ProductUrl, &product.ImageUrl,
-		&product.UnitCost, &product.UnitPrice, &product.Margin, &product.MarginRate)
+	products, err := queryProducts(ctx, db, query, accountId, categoryId, pid)
+	if len(products) > 0 {
+		product = products[0]
+	}
+
+	return
+}
+
+// QueryComplementaryCategories returns the categories most often purchased from by the people
+// that purchased from one of the categories the person viewed or purchased from, leaving out
+// the person's own categories.
+func QueryComplementaryCategories(ctx context.Context, db *sql.DB, accountId int64, person *Person,
+	limit int) (categoryIds []string, err error) {
+
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	s := []string{}
+
+	myCategories := "SELECT category_id FROM product_category WHERE account_id = $1 AND pid IN (" +
+		personPidsQuery() + ")"
+	theirs := interactedQuery("user_product_purchases", PurchaseEvent, "monetate_id",
+		"account_id = $1 AND monetate_id <> $2 AND pid IN (SELECT pid FROM product_category "+
+			"WHERE account_id = $1 AND category_id IN ("+myCategories+"))")
+
+	s = append(s, "SELECT other_pc.category_id")
+	s = append(s, "FROM (")
+	// everything bought by the other people that bought from one of the person's categories
+	s = append(s, interactedQuery("user_product_purchases", PurchaseEvent, "monetate_id, pid",
+		"account_id = $1 AND monetate_id IN ("+theirs+")"))
+	s = append(s, ") other")
+	s = append(s, "JOIN product_category other_pc ON (")
+	s = append(s, "other_pc.account_id = $1 AND")
+	s = append(s, "other_pc.pid = other.pid)")
+	s = append(s, "WHERE other_pc.category_id NOT IN ("+myCategories+")")
+	s = append(s, "GROUP BY other_pc.category_id")
+	s = append(s, "ORDER BY COUNT(DISTINCT other.monetate_id) DESC, other_pc.category_id")
+	s = append(s, "LIMIT $3")
+
+	query := strings.Join(s, " ")
+
+	rows, err := db.QueryContext(ctx, query, accountId, person.MonetateId, limit)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			product = nil
-		} else {
-			panic(err)
+		return
+	}
+	defer rows.Close()
+
+	categoryIds = make([]string, 0)
+
+	for rows.Next() {
+		var categoryId string
+		err = rows.Scan(&categoryId)
+		if err != nil {
+			return
 		}
+		categoryIds = append(categoryIds, categoryId)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return
 	}
 
 	return
 }
 
-func HasProductBeenSeenByPerson(db *sql.DB, accountId int64, person *Person, product *Product) (seen bool) {
+// QueryPersonProductViewCount returns how many times the person viewed the product, 0 if never,
+// discounted by the decay.
+func QueryPersonProductViewCount(ctx context.Context, db *sql.DB, accountId int64, person *Person,
+	product *Product, decay *Decay) (count float64, err error) {
+
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
 	s := []string{}
 
-	s = append(s, "SELECT 'x'")
-	s = append(s, "FROM user_product_views u JOIN product p ON (")
-	s = append(s, "u.account_id = p.account_id AND")
-	s = append(s, "u.pid = p.pid)")
+	s = append(s, "SELECT COALESCE(SUM("+decay.weight("u")+"), 0)")
+	s = append(s, "FROM "+interactionsQuery("user_product_views", ViewEvent)+" u")
 	s = append(s, "WHERE u.account_id = $1 AND u.monetate_id = $2 AND u.pid = $3")
 
 	query := strings.Join(s, " ")
 
-	row := db.QueryRow(query, accountId, person.MonetateId, product.Pid)
-	var foo string
-	err := row.Scan(&foo)
-	if err == nil {
-		seen = true
-	} else {
-		if err == sql.ErrNoRows {
-			seen = false
-		} else {
-			panic(err)
-		}
+	row := db.QueryRowContext(ctx, query, accountId, person.MonetateId, product.Pid)
+	err = row.Scan(&count)
+	if err != nil {
+		return
 	}
-
 	return
 }
 
-func HasProductBeenPurchasedByPerson(db *sql.DB, accountId int64, person *Person, product *Product) (seen bool) {
+func HasProductBeenPurchasedByPerson(ctx context.Context, db *sql.DB, accountId int64,
+	person *Person, product *Product) (seen bool, err error) {
+
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
 	s := []string{}
 
 	s = append(s, "SELECT 'x'")
-	s = append(s, "FROM user_product_purchases u JOIN product p ON (")
+	s = append(s, "FROM "+interactionsQuery("user_product_purchases", PurchaseEvent)+" u JOIN product p ON (")
 	s = append(s, "u.account_id = p.account_id AND")
 	s = append(s, "u.pid = p.pid)")
 	s = append(s, "WHERE u.account_id = $1 AND u.monetate_id = $2 AND u.pid = $3")
 
 	query := strings.Join(s, " ")
 
-	row := db.QueryRow(query, accountId, person.MonetateId, product.Pid)
+	row := db.QueryRowContext(ctx, query, accountId, person.MonetateId, product.Pid)
 	var foo string
-	err := row.Scan(&foo)
+	err = row.Scan(&foo)
 	if err == nil {
 		seen = true
-	} else {
-		if err == sql.ErrNoRows {
-			seen = false
-		} else {
-			panic(err)
-		}
+	} else if err == sql.ErrNoRows {
+		seen = false
+		err = nil
 	}
 
 	return
 }
 
-func QueryGlobalConversion(db *sql.DB, accountId int64, product *Product) (conversionRate float64) {
+func QueryGlobalConversion(ctx context.Context, db *sql.DB, accountId int64,
+	product *Product) (conversionRate float64, err error) {
+
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
 	s := []string{}
 
 	s = append(s, "SELECT conversion_rate")
@@ -366,23 +528,322 @@ func QueryGlobalConversion(db *sql.DB, accountId int64, product *Product) (conve
 
 	query := strings.Join(s, " ")
 
-	row := db.QueryRow(query, accountId, product.Pid)
-	err := row.Scan(&conversionRate)
+	row := db.QueryRowContext(ctx, query, accountId, product.Pid)
+	err = row.Scan(&conversionRate)
+	if err == sql.ErrNoRows {
+		conversionRate = 0.0
+		err = nil
+	}
+
+	return
+}
+
+func queryProducts(ctx context.Context, db *sql.DB, query string,
+	args ...interface{}) (products []*Product, err error) {
+
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, query, args...)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			conversionRate = 0.0
-		} else {
-			panic(err)
+		return
+	}
+	defer rows.Close()
+
+	products = make([]*Product, 0)
+
+	for rows.Next() {
+		p := &Product{}
+		err = rows.Scan(&p.AccountId, &p.Pid, &p.Name, &p.ProductUrl, &p.ImageUrl, &p.UnitCost,
+			&p.UnitPrice, &p.Margin, &p.MarginRate, &p.CategoryId, &p.CategoryName)
+		if err != nil {
+			return
 		}
+		products = append(products, p)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+// QueryMostViewedProducts returns the products with the highest total view counts across
+// all visitors, most viewed first.
+func QueryMostViewedProducts(ctx context.Context, db *sql.DB, accountId int64,
+	limit int) (products []*Product, err error) {
+
+	s := []string{}
+
+	s = append(s, "SELECT")
+	s = append(s, "p.account_id, p.pid, p.name, p.product_url, p.image_url, p.unit_cost,")
+	s = append(s, "p.unit_price, p.margin, p.margin_rate,")
+	s = append(s, "COALESCE(pc.category_id, ''), COALESCE(pc.category_name, '')")
+	s = append(s, "FROM product p JOIN (")
+	s = append(s, "SELECT pid, SUM(count) AS views")
+	s = append(s, "FROM "+interactionsQuery("user_product_views", ViewEvent)+" u")
+	s = append(s, "WHERE account_id = $1")
+	s = append(s, "GROUP BY pid) v ON (p.pid = v.pid)")
+	s = append(s, "LEFT JOIN product_category pc ON (p.account_id = pc.account_id AND p.pid = pc.pid)")
+	s = append(s, "WHERE p.account_id = $1")
+	s = append(s, "ORDER BY v.views DESC, p.pid")
+	s = append(s, "LIMIT $2")
+
+	query := strings.Join(s, " ")
+
+	products, err = queryProducts(ctx, db, query, accountId, limit)
+	return
+}
+
+// QueryTopConversionProducts returns the products with the highest global conversion rates,
+// highest first.
+func QueryTopConversionProducts(ctx context.Context, db *sql.DB, accountId int64,
+	limit int) (products []*Product, err error) {
+
+	s := []string{}
+
+	s = append(s, "SELECT")
+	s = append(s, "p.account_id, p.pid, p.name, p.product_url, p.image_url, p.unit_cost,")
+	s = append(s, "p.unit_price, p.margin, p.margin_rate,")
+	s = append(s, "COALESCE(pc.category_id, ''), COALESCE(pc.category_name, '')")
+	s = append(s, "FROM product p JOIN product_conversion_rate c ON (")
+	s = append(s, "p.account_id = c.account_id AND")
+	s = append(s, "p.pid = c.pid)")
+	s = append(s, "LEFT JOIN product_category pc ON (p.account_id = pc.account_id AND p.pid = pc.pid)")
+	s = append(s, "WHERE p.account_id = $1")
+	s = append(s, "ORDER BY c.conversion_rate DESC, p.pid")
+	s = append(s, "LIMIT $2")
+
+	query := strings.Join(s, " ")
+
+	products, err = queryProducts(ctx, db, query, accountId, limit)
+	return
+}
+
+// QueryCoViewedProducts returns the products most often viewed by the people that also
+// viewed one of the person's viewed products, excluding the person's own views.
+func QueryCoViewedProducts(ctx context.Context, db *sql.DB, accountId int64, person *Person,
+	limit int) (products []*Product, err error) {
+
+	s := []string{}
+
+	myViews := interactedQuery("user_product_views", ViewEvent, "pid",
+		"account_id = $1 AND monetate_id = $2")
+	theirs := interactedQuery("user_product_views", ViewEvent, "monetate_id",
+		"account_id = $1 AND monetate_id <> $2 AND pid IN ("+myViews+")")
+
+	s = append(s, "SELECT")
+	s = append(s, "p.account_id, p.pid, p.name, p.product_url, p.image_url, p.unit_cost,")
+	s = append(s, "p.unit_price, p.margin, p.margin_rate,")
+	s = append(s, "COALESCE(pc.category_id, ''), COALESCE(pc.category_name, '')")
+	s = append(s, "FROM product p JOIN (")
+	s = append(s, "SELECT other.pid, COUNT(DISTINCT other.monetate_id) AS people")
+	s = append(s, "FROM (")
+	// everything viewed by the other people that viewed one of the person's views
+	s = append(s, interactedQuery("user_product_views", ViewEvent, "monetate_id, pid",
+		"account_id = $1 AND monetate_id IN ("+theirs+")"))
+	s = append(s, ") other")
+	s = append(s, "WHERE other.pid NOT IN ("+myViews+")")
+	s = append(s, "GROUP BY other.pid) c ON (p.pid = c.pid)")
+	s = append(s, "LEFT JOIN product_category pc ON (p.account_id = pc.account_id AND p.pid = pc.pid)")
+	s = append(s, "WHERE p.account_id = $1")
+	s = append(s, "ORDER BY c.people DESC, p.pid")
+	s = append(s, "LIMIT $3")
+
+	query := strings.Join(s, " ")
+
+	products, err = queryProducts(ctx, db, query, accountId, person.MonetateId, limit)
+	return
+}
+
+// QueryCoPurchasedProducts returns the products most often purchased by the people that also
+// purchased one of the products the person viewed or purchased, excluding those products.
+func QueryCoPurchasedProducts(ctx context.Context, db *sql.DB, accountId int64, person *Person,
+	limit int) (products []*Product, err error) {
+
+	s := []string{}
+
+	theirs := interactedQuery("user_product_purchases", PurchaseEvent, "monetate_id",
+		"account_id = $1 AND monetate_id <> $2 AND pid IN ("+personPidsQuery()+")")
+
+	s = append(s, "SELECT")
+	s = append(s, "p.account_id, p.pid, p.name, p.product_url, p.image_url, p.unit_cost,")
+	s = append(s, "p.unit_price, p.margin, p.margin_rate,")
+	s = append(s, "COALESCE(pc.category_id, ''), COALESCE(pc.category_name, '')")
+	s = append(s, "FROM product p JOIN (")
+	s = append(s, "SELECT other.pid, COUNT(DISTINCT other.monetate_id) AS people")
+	s = append(s, "FROM (")
+	// everything bought by the other people that bought one of the person's products
+	s = append(s, interactedQuery("user_product_purchases", PurchaseEvent, "monetate_id, pid",
+		"account_id = $1 AND monetate_id IN ("+theirs+")"))
+	s = append(s, ") other")
+	s = append(s, "WHERE other.pid NOT IN ("+personPidsQuery()+")")
+	s = append(s, "GROUP BY other.pid) c ON (p.pid = c.pid)")
+	s = append(s, "LEFT JOIN product_category pc ON (p.account_id = pc.account_id AND p.pid = pc.pid)")
+	s = append(s, "WHERE p.account_id = $1")
+	s = append(s, "ORDER BY c.people DESC, p.pid")
+	s = append(s, "LIMIT $3")
+
+	query := strings.Join(s, " ")
+
+	products, err = queryProducts(ctx, db, query, accountId, person.MonetateId, limit)
+	return
+}
+
+// QueryCoOccurrenceCount returns how many other people viewed the product as well as at
+// least one of the products the person viewed.
+func QueryCoOccurrenceCount(ctx context.Context, db *sql.DB, accountId int64, person *Person,
+	product *Product) (count int, err error) {
+
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	s := []string{}
+
+	myViews := interactedQuery("user_product_views", ViewEvent, "pid",
+		"account_id = $1 AND monetate_id = $2")
+	alsoViewed := interactedQuery("user_product_views", ViewEvent, "monetate_id",
+		"account_id = $1 AND pid IN ("+myViews+")")
+
+	s = append(s, "SELECT COUNT(DISTINCT monetate_id)")
+	s = append(s, "FROM (")
+	// the other people that viewed the product and one of the person's views
+	s = append(s, interactedQuery("user_product_views", ViewEvent, "monetate_id",
+		"account_id = $1 AND pid = $3 AND monetate_id <> $2 AND monetate_id IN ("+alsoViewed+")"))
+	s = append(s, ") theirs")
+
+	query := strings.Join(s, " ")
+
+	row := db.QueryRowContext(ctx, query, accountId, person.MonetateId, product.Pid)
+	err = row.Scan(&count)
+	if err != nil {
+		return
+	}
+	return
+}
+
+// QueryProductViewCount returns the total number of views of the product across everyone.
+func QueryProductViewCount(ctx context.Context, db *sql.DB, accountId int64,
+	product *Product) (views int64, err error) {
+
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	s := []string{}
+
+	s = append(s, "SELECT COALESCE(SUM(count), 0)")
+	s = append(s, "FROM "+interactionsQuery("user_product_views", ViewEvent)+" u")
+	s = append(s, "WHERE account_id = $1 AND pid = $2")
+
+	query := strings.Join(s, " ")
+
+	row := db.QueryRowContext(ctx, query, accountId, product.Pid)
+	err = row.Scan(&views)
+	if err != nil {
+		return
 	}
+	return
+}
+
+func QueryAllProducts(ctx context.Context, db *sql.DB,
+	accountId int64) (products []*Product, err error) {
+
+	s := []string{}
+
+	s = append(s, "SELECT")
+	s = append(s, "p.account_id, p.pid, p.name, p.product_url, p.image_url, p.unit_cost,")
+	s = append(s, "p.unit_price, p.margin, p.margin_rate,")
+	s = append(s, "COALESCE(pc.category_id, ''), COALESCE(pc.category_name, '')")
+	s = append(s, "FROM product p")
+	s = append(s, "LEFT JOIN product_category pc ON (p.account_id = pc.account_id AND p.pid = pc.pid)")
+	s = append(s, "WHERE p.account_id = $1")
+	s = append(s, "ORDER BY p.pid")
+
+	query := strings.Join(s, " ")
 
+	products, err = queryProducts(ctx, db, query, accountId)
 	return
 }
 
+func QueryProductCount(ctx context.Context, db *sql.DB,
+	accountId int64) (count int, err error) {
+
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	row := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM product WHERE account_id = $1", accountId)
+	err = row.Scan(&count)
+	if err != nil {
+		return
+	}
+	return
+}
+
+// DSN is the database OpenDB connects to, a postgresql connection string or a sqlite file,
+// see sqlitePath.
+var DSN = "dbname=recogen sslmode=disable"
+
+// PoolConfig sizes the connection pool of every database OpenDB opens.
+type PoolConfig struct {
+	MaxOpenConns           int           // 0 for no limit
+	MaxIdleConns           int           // connections kept open between queries
+	ConnMaxLifetime        time.Duration // 0 to keep connections forever
+	StatementCacheCapacity int           // prepared statements cached per postgresql connection
+}
+
+// the evolver queries from every genome at once, so allow about a connection each
+var Pool = PoolConfig{MaxOpenConns: 32, MaxIdleConns: 8, ConnMaxLifetime: 30 * time.Minute,
+	StatementCacheCapacity: 512}
+
+// QueryTimeout is how long any one of the Query functions can run before it's cancelled, 0 for
+// no limit.
+var QueryTimeout = time.Minute
+
+// withQueryTimeout bounds a query by QueryTimeout as well as by the caller's context.
+func withQueryTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if QueryTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, QueryTimeout)
+}
+
+// isSQLite reports whether OpenDB connects to sqlite, for the few queries that differ.
+func isSQLite() bool {
+	return sqlitePath(DSN) != ""
+}
+
 func OpenDB() (db *sql.DB) {
-	db, err := sql.Open("postgres", "dbname=recogen sslmode=disable")
-	if err == nil {
+	var err error
+	if path := sqlitePath(DSN); path != "" {
+		db, err = openSQLite(path)
+	} else {
+		db, err = openPostgres(DSN)
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	db.SetMaxOpenConns(Pool.MaxOpenConns)
+	db.SetMaxIdleConns(Pool.MaxIdleConns)
+	db.SetConnMaxLifetime(Pool.ConnMaxLifetime)
+	return
+}
+
+// openPostgres connects through pgx, which prepares and caches every statement it's given so
+// that repeated queries are only parsed once per connection.
+func openPostgres(dsn string) (db *sql.DB, err error) {
+	config, err := pgx.ParseConfig(dsn)
+	if err != nil {
 		return
 	}
-	panic(err)
+	config.DefaultQueryExecMode = pgx.QueryExecModeCacheStatement
+	config.StatementCacheCapacity = Pool.StatementCacheCapacity
+	if searchPath != "" {
+		config.RuntimeParams["search_path"] = searchPath
+	}
+
+	db = stdlib.OpenDB(*config)
+	return
 }
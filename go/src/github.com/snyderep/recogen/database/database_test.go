@@ -0,0 +1,148 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"reflect"
+	"testing"
+)
+
+const testAccountId = 321
+
+// openInteractionsDB loads a few people whose views and purchases are split between the
+// aggregate tables and the event stream:
+//
+//	me views 1 (table, twice) and 2 (event)
+//	x  views 1 (table) and 3 (event), buys 3 (event) and 6 (table)
+//	y  views 2 (event) and 4 (table), buys 1 (event) and 5 (table)
+//	z  views 5 (table)
+//
+// Products 1 and 2 are in category a, 5 in b and 6 in c.
+func openInteractionsDB(t *testing.T) (db *sql.DB) {
+	db = openTestDB(t, true)
+	for _, pid := range []string{"1", "2", "3", "4", "5", "6"} {
+		testExec(t, db, "INSERT INTO product (account_id, pid, name, product_url, image_url, "+
+			"unit_cost, unit_price, margin, margin_rate) VALUES ($1, $2, $3, '', '', 0, 1, 0, 0)",
+			testAccountId, pid, "product "+pid)
+	}
+	for _, c := range [][]string{{"1", "a"}, {"2", "a"}, {"5", "b"}, {"6", "c"}} {
+		testExec(t, db, "INSERT INTO product_category (account_id, pid, category_id) "+
+			"VALUES ($1, $2, $3)", testAccountId, c[0], c[1])
+	}
+	testExec(t, db, "INSERT INTO user_product_views (account_id, monetate_id, pid, count) "+
+		"VALUES ($1, 'me', '1', 2), ($1, 'x', '1', 1), ($1, 'y', '4', 1), ($1, 'z', '5', 1)",
+		testAccountId)
+	testExec(t, db, "INSERT INTO user_product_purchases (account_id, monetate_id, pid, count) "+
+		"VALUES ($1, 'x', '6', 1), ($1, 'y', '5', 1)", testAccountId)
+	testExec(t, db, "INSERT INTO user_product_event (account_id, monetate_id, pid, event_type, "+
+		"event_time) VALUES ($1, 'me', '2', 'view', '2012-12-14 10:00:00'), "+
+		"($1, 'x', '3', 'view', '2012-12-14 10:01:00'), "+
+		"($1, 'x', '3', 'purchase', '2012-12-14 10:02:00'), "+
+		"($1, 'y', '2', 'view', '2012-12-14 10:03:00'), "+
+		"($1, 'y', '1', 'purchase', '2012-12-14 10:04:00'), "+
+		"($1, 'y', '1', 'add_to_cart', '2012-12-14 10:04:00')", testAccountId)
+	return
+}
+
+func pids(products []*Product) (pids []string) {
+	pids = make([]string, 0)
+	for _, p := range products {
+		pids = append(pids, p.Pid)
+	}
+	return
+}
+
+func TestQueriesCountEvents(t *testing.T) {
+	ctx := context.Background()
+	db := openInteractionsDB(t)
+	me := &Person{MonetateId: "me"}
+
+	tests := []struct {
+		name  string
+		query func() ([]*Product, error)
+		want  []string
+	}{
+		{"co-viewed", func() ([]*Product, error) {
+			return QueryCoViewedProducts(ctx, db, testAccountId, me, 10)
+		}, []string{"3", "4"}},
+		{"co-purchased", func() ([]*Product, error) {
+			return QueryCoPurchasedProducts(ctx, db, testAccountId, me, 10)
+		}, []string{"5"}},
+		{"most viewed", func() ([]*Product, error) {
+			return QueryMostViewedProducts(ctx, db, testAccountId, 10)
+		}, []string{"1", "2", "3", "4", "5"}},
+	}
+
+	for _, test := range tests {
+		products, err := test.query()
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if got := pids(products); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	categories, err := QueryComplementaryCategories(ctx, db, testAccountId, me, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(categories, []string{"b"}) {
+		t.Errorf("complementary categories: got %v, want [b]", categories)
+	}
+
+	for pid, want := range map[string]int{"3": 1, "4": 1, "5": 0, "1": 1} {
+		count, err := QueryCoOccurrenceCount(ctx, db, testAccountId, me, &Product{Pid: pid})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != want {
+			t.Errorf("co-occurrence count of %s: got %d, want %d", pid, count, want)
+		}
+	}
+}
+
+func TestBuildsCountEvents(t *testing.T) {
+	ctx := context.Background()
+	db := openInteractionsDB(t)
+
+	err := BuildProductCoOccurrences(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	err = db.QueryRow("SELECT count FROM product_cooccurrence WHERE account_id = $1 AND "+
+		"source = 'view' AND pid = '1' AND other_pid = '3'", testAccountId).Scan(&count)
+	if err != nil {
+		t.Fatalf("no co-occurrence of a viewed product and a view event: %v", err)
+	}
+	if count != 1 {
+		t.Errorf("1 and 3 co-occur %d times, want 1", count)
+	}
+
+	err = BuildProductConversionRates(ctx, db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rates := make(map[string]float64)
+	rows, err := db.Query("SELECT pid, conversion_rate FROM product_conversion_rate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var pid string
+		var rate float64
+		err = rows.Scan(&pid, &rate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rates[pid] = rate
+	}
+	// with no prior each rate is purchases over views, 3 has only events
+	want := map[string]float64{"1": 1.0 / 3.0, "2": 0.0, "3": 1.0, "4": 0.0, "5": 1.0}
+	if !reflect.DeepEqual(rates, want) {
+		t.Errorf("got rates %v, want %v", rates, want)
+	}
+}
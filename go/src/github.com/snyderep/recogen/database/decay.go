@@ -0,0 +1,69 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Decay discounts interactions by age, halving their weight every HalfLife days counted back
+// from Reference. Interactions without a date aren't discounted. A nil Decay, or one with a
+// HalfLife of zero, leaves every interaction at full weight.
+type Decay struct {
+	Reference time.Time
+	HalfLife  float64
+}
+
+// weight returns the SQL for the decayed weight of an interaction table's count column.
+// Only the decay's own values are put into the SQL, so it can be used anywhere in a query
+// without disturbing the numbering of the parameters.
+func (d *Decay) weight(alias string) string {
+	count := "CAST(" + alias + ".count AS FLOAT)"
+	if d == nil || d.HalfLife <= 0.0 || d.Reference.IsZero() {
+		return count
+	}
+	ref := "DATE '" + d.Reference.Format("2006-01-02") + "'"
+	age := fmt.Sprintf("(%s - COALESCE(%s.last_dt, %s))", ref, alias, ref)
+	if isSQLite() {
+		// sqlite keeps dates as text, so subtract their julian days instead
+		ref = "'" + d.Reference.Format("2006-01-02") + "'"
+		age = fmt.Sprintf("(julianday(%s) - julianday(COALESCE(%s.last_dt, %s)))", ref, alias, ref)
+	}
+	return fmt.Sprintf("%s * POWER(0.5, %s / %f)", count, age, d.HalfLife)
+}
+
+// QueryLatestInteraction returns the most recent view date for the account, view events
+// included, the zero time if none of the views are dated.
+func QueryLatestInteraction(ctx context.Context, db *sql.DB,
+	accountId int64) (latest time.Time, err error) {
+
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	if isSQLite() {
+		// sqlite keeps dates as text, and MAX loses the column's type so it isn't parsed
+		var ns sql.NullString
+		row := db.QueryRowContext(ctx, "SELECT date(MAX(last_dt)) FROM "+
+			interactionsQuery("user_product_views", ViewEvent)+" u WHERE account_id = $1",
+			accountId)
+		err = row.Scan(&ns)
+		if err != nil {
+			return
+		}
+		if ns.Valid {
+			latest, err = time.Parse("2006-01-02", ns.String)
+		}
+		return
+	}
+
+	var nt sql.NullTime
+	row := db.QueryRowContext(ctx, "SELECT MAX(last_dt) FROM "+
+		interactionsQuery("user_product_views", ViewEvent)+" u WHERE account_id = $1", accountId)
+	err = row.Scan(&nt)
+	if err != nil {
+		return
+	}
+	latest = nt.Time
+	return
+}
@@ -0,0 +1,279 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ViewEvent      = "view"
+	AddToCartEvent = "add_to_cart"
+	PurchaseEvent  = "purchase"
+	WishlistEvent  = "wishlist"
+)
+
+// the columns of a tab separated event file, csv and json files name their own
+var eventColumns = []string{"account_id", "monetate_id", "pid", "event_time", "event_type"}
+
+// normalizeEventType maps the spellings used by the various feeds onto the event types,
+// returning an empty string for anything it doesn't recognise.
+func normalizeEventType(s string) string {
+	t := strings.ToLower(strings.TrimSpace(s))
+	t = strings.Replace(t, "-", "_", -1)
+	t = strings.Replace(t, " ", "_", -1)
+	switch t {
+	case ViewEvent, "pageview", "product_view":
+		return ViewEvent
+	case AddToCartEvent, "addtocart", "cart", "add_cart":
+		return AddToCartEvent
+	case PurchaseEvent, "order", "conversion":
+		return PurchaseEvent
+	case WishlistEvent, "wish_list", "add_to_wishlist":
+		return WishlistEvent
+	}
+	return ""
+}
+
+func deleteAllUserProductEvents(trans *sql.Tx) (err error) {
+	_, err = trans.Exec("DELETE FROM user_product_event")
+	return
+}
+
+// parseEventTime accepts RFC 3339, "yyyy-mm-dd hh:mm:ss" or milliseconds since the epoch.
+func parseEventTime(s string) (t time.Time, err error) {
+	t, err = time.Parse(time.RFC3339, s)
+	if err == nil {
+		return
+	}
+	t, err = time.Parse("2006-01-02 15:04:05", s)
+	if err == nil {
+		return
+	}
+	var ms int64
+	ms, err = strconv.ParseInt(s, 10, 64)
+	if err == nil {
+		t = time.Unix(ms/1000, (ms%1000)*int64(time.Millisecond)).UTC()
+	}
+	return
+}
+
+func hasDataFile(filename string) bool {
+	_, err := os.Stat(filepath.Join(dataBasePath, filename))
+	return err == nil
+}
+
+// findEventFile returns the name of the event file in the data directory, or an empty string
+// if there isn't one.
+func findEventFile() string {
+	return findDataFile(dataFilenames("user_product_events")...)
+}
+
+// LoadUserProductEvents loads the ordered event stream: account id, monetate id, pid, event
+// time and event type. The file can be tab separated, csv with a header or json lines.
+func LoadUserProductEvents(ctx context.Context, db *sql.DB, report *FileReport) (err error) {
+	fmt.Println("loading user product events")
+
+	err = deleteAll(ctx, db, deleteAllUserProductEvents)
+	if err != nil {
+		return
+	}
+
+	file, reader := openRecords("user_product_events", eventColumns)
+	defer file.Close()
+
+	writer := newBulkWriter(ctx, db, "user_product_event", "account_id", "monetate_id", "pid",
+		"event_type", "event_time")
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if report.rejects(reader.Line()) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		accountId, err := strconv.ParseInt(record["account_id"], 10, 32)
+		if err != nil {
+			return err
+		}
+		eventTime, err := parseEventTime(record["event_time"])
+		if err != nil {
+			return err
+		}
+		eventType := normalizeEventType(record["event_type"])
+		if eventType == "" {
+			return fmt.Errorf("line %d: unknown event type %q", reader.Line(),
+				record["event_type"])
+		}
+
+		err = writer.add(accountId, record["monetate_id"], record["pid"], eventType, eventTime)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = writer.close()
+	return
+}
+
+// QueryProductsWithEvent returns the products the person has an event of the given type for,
+// most recent first.
+func QueryProductsWithEvent(ctx context.Context, db *sql.DB, accountId int64, person *Person,
+	eventType string) (products []*Product, err error) {
+
+	s := []string{}
+
+	s = append(s, "SELECT")
+	s = append(s, "p.account_id, p.pid, p.name, p.product_url, p.image_url, p.unit_cost,")
+	s = append(s, "p.unit_price, p.margin, p.margin_rate,")
+	s = append(s, "COALESCE(pc.category_id, ''), COALESCE(pc.category_name, '')")
+	s = append(s, "FROM product p JOIN (")
+	s = append(s, "SELECT pid, MAX(event_time) AS last_time")
+	s = append(s, "FROM user_product_event")
+	s = append(s, "WHERE account_id = $1 AND monetate_id = $2 AND event_type = $3")
+	s = append(s, "GROUP BY pid) e ON (p.pid = e.pid)")
+	s = append(s, "LEFT JOIN product_category pc ON (p.account_id = pc.account_id AND p.pid = pc.pid)")
+	s = append(s, "WHERE p.account_id = $1")
+	s = append(s, "ORDER BY e.last_time DESC, p.pid")
+
+	query := strings.Join(s, " ")
+
+	products, err = queryProducts(ctx, db, query, accountId, person.MonetateId, eventType)
+	return
+}
+
+// QueryPersonProductEventCounts returns how many events of each type the person has for the
+// product. Types without any events are missing from the map.
+func QueryPersonProductEventCounts(ctx context.Context, db *sql.DB, accountId int64, person *Person,
+	product *Product) (counts map[string]int64, err error) {
+
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	s := []string{}
+
+	s = append(s, "SELECT event_type, COUNT(*)")
+	s = append(s, "FROM user_product_event")
+	s = append(s, "WHERE account_id = $1 AND monetate_id = $2 AND pid = $3")
+	s = append(s, "GROUP BY event_type")
+
+	query := strings.Join(s, " ")
+
+	rows, err := db.QueryContext(ctx, query, accountId, person.MonetateId, product.Pid)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	counts = make(map[string]int64)
+
+	for rows.Next() {
+		var eventType string
+		var count int64
+		err = rows.Scan(&eventType, &count)
+		if err != nil {
+			return
+		}
+		counts[eventType] = count
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+// QueryRecentlyViewedProducts returns the last n distinct products the person viewed, most
+// recent first.
+func QueryRecentlyViewedProducts(ctx context.Context, db *sql.DB, accountId int64, person *Person,
+	n int) (products []*Product, err error) {
+
+	s := []string{}
+
+	s = append(s, "SELECT")
+	s = append(s, "p.account_id, p.pid, p.name, p.product_url, p.image_url, p.unit_cost,")
+	s = append(s, "p.unit_price, p.margin, p.margin_rate,")
+	s = append(s, "COALESCE(pc.category_id, ''), COALESCE(pc.category_name, '')")
+	s = append(s, "FROM product p JOIN (")
+	s = append(s, "SELECT pid, MAX(event_time) AS last_time")
+	s = append(s, "FROM user_product_event")
+	s = append(s, "WHERE account_id = $1 AND monetate_id = $2 AND event_type = $3")
+	s = append(s, "GROUP BY pid) e ON (p.pid = e.pid)")
+	s = append(s, "LEFT JOIN product_category pc ON (p.account_id = pc.account_id AND p.pid = pc.pid)")
+	s = append(s, "WHERE p.account_id = $1")
+	s = append(s, "ORDER BY e.last_time DESC, p.pid")
+	s = append(s, "LIMIT $4")
+
+	query := strings.Join(s, " ")
+
+	products, err = queryProducts(ctx, db, query, accountId, person.MonetateId, ViewEvent, n)
+	return
+}
+
+// QueryNextViewedProducts returns the products viewed straight after the product, weighted by
+// the probability of that transition across everyone's event streams, most likely first.
+func QueryNextViewedProducts(ctx context.Context, db *sql.DB, accountId int64, product *Product,
+	limit int) (neighbours []*Neighbour, err error) {
+
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	s := []string{}
+
+	s = append(s, "SELECT")
+	s = append(s, "p.account_id, p.pid, p.name, p.product_url, p.image_url, p.unit_cost,")
+	s = append(s, "p.unit_price, p.margin, p.margin_rate,")
+	s = append(s, "COALESCE(pc.category_id, ''), COALESCE(pc.category_name, ''),")
+	s = append(s, "CAST(t.transitions AS FLOAT) / SUM(t.transitions) OVER ()")
+	s = append(s, "FROM product p JOIN (")
+	s = append(s, "SELECT seq.next_pid, COUNT(*) AS transitions")
+	s = append(s, "FROM (")
+	s = append(s, "SELECT pid, LEAD(pid) OVER (PARTITION BY monetate_id ORDER BY event_time) AS next_pid")
+	s = append(s, "FROM user_product_event")
+	s = append(s, "WHERE account_id = $1 AND event_type = $3) seq")
+	s = append(s, "WHERE seq.pid = $2 AND seq.next_pid IS NOT NULL AND seq.next_pid <> seq.pid")
+	s = append(s, "GROUP BY seq.next_pid) t ON (p.pid = t.next_pid)")
+	s = append(s, "LEFT JOIN product_category pc ON (p.account_id = pc.account_id AND p.pid = pc.pid)")
+	s = append(s, "WHERE p.account_id = $1")
+	s = append(s, "ORDER BY t.transitions DESC, p.pid")
+	s = append(s, "LIMIT $4")
+
+	query := strings.Join(s, " ")
+
+	rows, err := db.QueryContext(ctx, query, accountId, product.Pid, ViewEvent, limit)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	neighbours = make([]*Neighbour, 0)
+
+	for rows.Next() {
+		n := &Neighbour{Product: &Product{}}
+		p := n.Product
+		err = rows.Scan(&p.AccountId, &p.Pid, &p.Name, &p.ProductUrl, &p.ImageUrl, &p.UnitCost,
+			&p.UnitPrice, &p.Margin, &p.MarginRate, &p.CategoryId, &p.CategoryName, &n.Weight)
+		if err != nil {
+			return
+		}
+		neighbours = append(neighbours, n)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return
+	}
+
+	return
+}
@@ -0,0 +1,155 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// QueryPeopleWithPurchases returns a random sample of people that purchased at least
+// minPurchases distinct products, counting only the purchases on or after since unless it's
+// the zero time. Purchase events count as purchases.
+func QueryPeopleWithPurchases(ctx context.Context, db *sql.DB, accountId int64, minPurchases int,
+	since time.Time, limit int) (people []*Person, err error) {
+
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	s := []string{}
+
+	s = append(s, "SELECT monetate_id")
+	s = append(s, "FROM "+interactionsQuery("user_product_purchases", PurchaseEvent)+" u")
+	s = append(s, "WHERE account_id = $1")
+	if !since.IsZero() {
+		s = append(s, "AND "+onOrAfter("last_dt", since))
+	}
+	s = append(s, "GROUP BY monetate_id")
+	s = append(s, "HAVING COUNT(DISTINCT pid) >= $2")
+	s = append(s, "ORDER BY RANDOM()")
+	s = append(s, "LIMIT $3")
+
+	query := strings.Join(s, " ")
+
+	rows, err := db.QueryContext(ctx, query, accountId, minPurchases, limit)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	people = make([]*Person, 0)
+
+	for rows.Next() {
+		p := &Person{}
+		err = rows.Scan(&p.MonetateId)
+		if err != nil {
+			return
+		}
+		people = append(people, p)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+// QueryPurchasedPids returns the pids the person purchased, events included, only those
+// purchased on or after since unless it's the zero time.
+func QueryPurchasedPids(ctx context.Context, db *sql.DB, accountId int64, person *Person,
+	since time.Time) (pids []string, err error) {
+
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	s := []string{}
+
+	s = append(s, "SELECT pid")
+	s = append(s, "FROM "+interactionsQuery("user_product_purchases", PurchaseEvent)+" u")
+	s = append(s, "WHERE account_id = $1 AND monetate_id = $2")
+	if !since.IsZero() {
+		s = append(s, "AND "+onOrAfter("last_dt", since))
+	}
+	s = append(s, "ORDER BY pid")
+
+	query := strings.Join(s, " ")
+
+	rows, err := db.QueryContext(ctx, query, accountId, person.MonetateId)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	pids = make([]string, 0)
+
+	for rows.Next() {
+		var pid string
+		err = rows.Scan(&pid)
+		if err != nil {
+			return
+		}
+		pids = append(pids, pid)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+// QueryPurchaseCutoff returns the day that splits the account's dated purchases, events
+// included, so that about the fraction of them given are on or after it, the zero time if none
+// of them are dated.
+func QueryPurchaseCutoff(ctx context.Context, db *sql.DB, accountId int64,
+	fraction float64) (cutoff time.Time, err error) {
+
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	var count int
+	row := db.QueryRowContext(ctx, "SELECT COUNT(last_dt) FROM "+
+		interactionsQuery("user_product_purchases", PurchaseEvent)+" u WHERE account_id = $1",
+		accountId)
+	err = row.Scan(&count)
+	if err != nil || count == 0 {
+		return
+	}
+	offset := int(float64(count) * (1.0 - fraction))
+	if offset >= count {
+		offset = count - 1
+	} else if offset < 0 {
+		offset = 0
+	}
+
+	s := []string{}
+
+	if isSQLite() {
+		// sqlite keeps dates as text, see QueryLatestInteraction
+		s = append(s, "SELECT date(last_dt)")
+	} else {
+		s = append(s, "SELECT last_dt")
+	}
+	s = append(s, "FROM "+interactionsQuery("user_product_purchases", PurchaseEvent)+" u")
+	s = append(s, "WHERE account_id = $1 AND last_dt IS NOT NULL")
+	s = append(s, "ORDER BY last_dt")
+	s = append(s, "LIMIT 1 OFFSET $2")
+
+	query := strings.Join(s, " ")
+
+	row = db.QueryRowContext(ctx, query, accountId, offset)
+	if isSQLite() {
+		var day string
+		err = row.Scan(&day)
+		if err != nil {
+			return
+		}
+		cutoff, err = time.Parse("2006-01-02", day)
+		return
+	}
+	err = row.Scan(&cutoff)
+	return
+}
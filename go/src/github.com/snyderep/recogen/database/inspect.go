@@ -0,0 +1,265 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"io"
+	"strconv"
+)
+
+// AccountStats is a summary of one account's data, for judging whether it's worth running
+// the evolver on.
+type AccountStats struct {
+	AccountId             int64
+	Products              int
+	ProductsWithoutName   int
+	ProductsWithoutImage  int
+	ViewsPerVisitor       map[string]int64 // keyed by monetate id
+	PurchasesPerVisitor   map[string]int64 // keyed by monetate id
+	ConversionRates       []float64
+	ViewedWithoutRate     int // viewed products that have no conversion rate
+	UnknownPidViews       int // view rows referring to products that don't exist
+	UnknownPidPurchases   int // purchase rows referring to products that don't exist
+	UnknownPidConversions int // conversion rates for products that don't exist
+	BadRows               int // rows in the data files that wouldn't load
+
+	pids       map[string]bool
+	viewedPids map[string]bool
+	ratedPids  map[string]bool
+}
+
+// Visitors is the number of people that viewed or purchased anything.
+func (as *AccountStats) Visitors() int {
+	visitors := len(as.ViewsPerVisitor)
+	for monetateId, _ := range as.PurchasesPerVisitor {
+		if _, ok := as.ViewsPerVisitor[monetateId]; !ok {
+			visitors += 1
+		}
+	}
+	return visitors
+}
+
+// inspector gathers the stats for every account. Products have to be added before anything
+// that refers to them.
+type inspector struct {
+	accounts map[int64]*AccountStats
+}
+
+func (in *inspector) account(accountId int64) (as *AccountStats) {
+	as, ok := in.accounts[accountId]
+	if !ok {
+		as = &AccountStats{AccountId: accountId, ViewsPerVisitor: make(map[string]int64),
+			PurchasesPerVisitor: make(map[string]int64), ConversionRates: make([]float64, 0),
+			pids: make(map[string]bool), viewedPids: make(map[string]bool),
+			ratedPids: make(map[string]bool)}
+		in.accounts[accountId] = as
+	}
+	return
+}
+
+func (in *inspector) product(accountId int64, pid string, name string, imageUrl string) {
+	as := in.account(accountId)
+	if as.pids[pid] {
+		// a duplicate, which the loader would reject
+		return
+	}
+	as.Products += 1
+	as.pids[pid] = true
+	if name == "" {
+		as.ProductsWithoutName += 1
+	}
+	if imageUrl == "" {
+		as.ProductsWithoutImage += 1
+	}
+}
+
+func (in *inspector) view(accountId int64, monetateId string, pid string, count int64) {
+	as := in.account(accountId)
+	as.ViewsPerVisitor[monetateId] += count
+	as.viewedPids[pid] = true
+	if !as.pids[pid] {
+		as.UnknownPidViews += 1
+	}
+}
+
+func (in *inspector) purchase(accountId int64, monetateId string, pid string, count int64) {
+	as := in.account(accountId)
+	as.PurchasesPerVisitor[monetateId] += count
+	if !as.pids[pid] {
+		as.UnknownPidPurchases += 1
+	}
+}
+
+func (in *inspector) conversionRate(accountId int64, pid string, rate float64) {
+	as := in.account(accountId)
+	as.ConversionRates = append(as.ConversionRates, rate)
+	as.ratedPids[pid] = true
+	if !as.pids[pid] {
+		as.UnknownPidConversions += 1
+	}
+}
+
+func (in *inspector) stats() map[int64]*AccountStats {
+	for _, as := range in.accounts {
+		for pid, _ := range as.viewedPids {
+			if as.pids[pid] && !as.ratedPids[pid] {
+				as.ViewedWithoutRate += 1
+			}
+		}
+	}
+	return in.accounts
+}
+
+// InspectTables gathers the stats for every account from the loaded tables.
+func InspectTables(ctx context.Context,
+	db *sql.DB) (stats map[int64]*AccountStats, err error) {
+
+	in := &inspector{accounts: make(map[int64]*AccountStats)}
+
+	err = scanRows(ctx, db,
+		"SELECT account_id, pid, COALESCE(name, ''), COALESCE(image_url, '') FROM product",
+		func(rows *sql.Rows) (err error) {
+			var accountId int64
+			var pid, name, imageUrl string
+			err = rows.Scan(&accountId, &pid, &name, &imageUrl)
+			if err == nil {
+				in.product(accountId, pid, name, imageUrl)
+			}
+			return
+		})
+	if err != nil {
+		return
+	}
+	err = scanRows(ctx, db, "SELECT account_id, monetate_id, pid, count FROM user_product_views",
+		func(rows *sql.Rows) (err error) {
+			var accountId, count int64
+			var monetateId, pid string
+			err = rows.Scan(&accountId, &monetateId, &pid, &count)
+			if err == nil {
+				in.view(accountId, monetateId, pid, count)
+			}
+			return
+		})
+	if err != nil {
+		return
+	}
+	err = scanRows(ctx, db, "SELECT account_id, monetate_id, pid, count FROM user_product_purchases",
+		func(rows *sql.Rows) (err error) {
+			var accountId, count int64
+			var monetateId, pid string
+			err = rows.Scan(&accountId, &monetateId, &pid, &count)
+			if err == nil {
+				in.purchase(accountId, monetateId, pid, count)
+			}
+			return
+		})
+	if err != nil {
+		return
+	}
+	err = scanRows(ctx, db, "SELECT account_id, pid, conversion_rate FROM product_conversion_rate",
+		func(rows *sql.Rows) (err error) {
+			var accountId int64
+			var pid string
+			var rate float64
+			err = rows.Scan(&accountId, &pid, &rate)
+			if err == nil {
+				in.conversionRate(accountId, pid, rate)
+			}
+			return
+		})
+	if err != nil {
+		return
+	}
+
+	stats = in.stats()
+	return
+}
+
+func scanRows(ctx context.Context, db *sql.DB, query string,
+	scan func(rows *sql.Rows) error) (err error) {
+
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		err = scan(rows)
+		if err != nil {
+			return
+		}
+	}
+
+	err = rows.Err()
+	return
+}
+
+// InspectFiles gathers the stats for every account straight from the data files, without
+// loading them. Rows that wouldn't load are counted but otherwise ignored.
+func InspectFiles() map[int64]*AccountStats {
+	in := &inspector{accounts: make(map[int64]*AccountStats)}
+	badRows := make(map[int64]int)
+
+	readRecords("products", productColumns, checkProductRow, badRows,
+		func(accountId int64, record map[string]string) {
+			in.product(accountId, record["pid"], record["name"], record["image_url"])
+		})
+	readRecords("user_products_viewed", userProductColumns, checkUserProductRow, badRows,
+		func(accountId int64, record map[string]string) {
+			count, _ := strconv.ParseInt(record["count"], 10, 32)
+			in.view(accountId, record["monetate_id"], record["pid"], count)
+		})
+	readRecords("user_products_purchased", userProductColumns, checkUserProductRow, badRows,
+		func(accountId int64, record map[string]string) {
+			count, _ := strconv.ParseInt(record["count"], 10, 32)
+			in.purchase(accountId, record["monetate_id"], record["pid"], count)
+		})
+	readRecords("global_conversion_rate", conversionRateColumns, checkConversionRateRow, badRows,
+		func(accountId int64, record map[string]string) {
+			rate, _ := strconv.ParseFloat(record["conversion_rate"], 64)
+			in.conversionRate(accountId, record["pid"], rate)
+		})
+
+	for accountId, n := range badRows {
+		in.account(accountId).BadRows += n
+	}
+
+	return in.stats()
+}
+
+// readRecords passes every record in the data file that passes the check to add. Records that
+// fail it are counted against their account, if it can be told. A missing file has no records.
+func readRecords(name string, columns []string, check checkRow, badRows map[int64]int,
+	add func(accountId int64, record map[string]string)) {
+
+	if findDataFile(dataFilenames(name)...) == "" {
+		return
+	}
+	file, reader := openRecords(name, columns)
+	defer file.Close()
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if _, ok := err.(*csv.ParseError); ok {
+			// the account can't be told, so these count against account 0
+			badRows[0] += 1
+			continue
+		} else if _, ok := err.(*recordError); ok {
+			badRows[0] += 1
+			continue
+		} else if err != nil {
+			panic(err)
+		}
+
+		accountId, _ := strconv.ParseInt(record["account_id"], 10, 32)
+		if _, _, reason := check(record); reason != "" {
+			badRows[accountId] += 1
+			continue
+		}
+		add(accountId, record)
+	}
+}
@@ -2,16 +2,23 @@ package database
 
 import (
 	"bufio"
+	"context"
 	"database/sql"
 	"encoding/csv"
 	"fmt"
 	"io"
+	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 )
 
-const dataBasePath = "/Users/esnyder/prj/w/genreco/data/"
+// the directory the data files are read from
+var dataBasePath = "/Users/esnyder/prj/w/genreco/data/"
 
 func openDataFile(filename string) (file *os.File) {
 	newPath := filepath.Join(dataBasePath, filename)
@@ -29,278 +36,406 @@ func getTabReader(file *os.File) (csvReader *csv.Reader) {
 	return
 }
 
-func LoadAllData() {
-	db := OpenDB()
-	defer db.Close()
+// product urls look like .../goods/Accessories/cat1260066/Suspenders-%26-Belts/p1000224/Neon+Suspenders/
+var categoryPattern = regexp.MustCompile(`/cat(\d+)/([^/]+)/`)
+
+// parseCategory pulls the category id and name out of a product url. Both are empty if the
+// url doesn't contain a category.
+func parseCategory(productUrl string) (categoryId string, categoryName string) {
+	m := categoryPattern.FindStringSubmatch(productUrl)
+	if m == nil {
+		return
+	}
+	categoryId = m[1]
+	name, err := url.QueryUnescape(m[2])
+	if err != nil {
+		name = m[2]
+	}
+	categoryName = strings.Replace(name, "-", " ", -1)
+	return
+}
 
-	ch := make(chan string, 10)
+// the columns of the tab separated files, in the order the hive queries write them. csv files
+// name their columns in a header and json lines files by key, in any order, and products can
+// also have a unit_cost or margin column.
+var (
+	productColumns = []string{"account_id", "pid", "name", "product_url", "image_url", "unit_price",
+		"category_id", "category_name"}
+	userProductColumns    = []string{"account_id", "monetate_id", "pid", "count", "last_dt"}
+	conversionRateColumns = []string{"account_id", "pid", "conversion_rate"}
+)
+
+// dataFilenames returns the names a data file can have, the extension decides the format.
+func dataFilenames(name string) []string {
+	return []string{name + ".txt", name + ".tsv", name + ".csv", name + ".jsonl", name + ".json"}
+}
+
+// openRecords opens the first data file found under any of the names for the base name and
+// returns a reader for its records.
+func openRecords(name string, tabColumns []string) (file *os.File, reader recordReader) {
+	filename := findDataFile(dataFilenames(name)...)
+	if filename == "" {
+		panic("no data file for " + name)
+	}
+	file = openDataFile(filename)
+	reader = getRecordReader(file, tabColumns)
+	return
+}
 
-	go LoadProducts(db, ch)
-	go LoadUserProductViews(db, ch)
-	go LoadUserProductPurchases(db, ch)
-	go LoadProductConversionRates(db, ch)
+// parseDay parses the optional last day of an interaction, yyyymmdd as hive writes it or
+// yyyy-mm-dd. An empty string is the zero time.
+func parseDay(s string) (dt time.Time, err error) {
+	if s == "" {
+		return
+	}
+	dt, err = time.Parse("20060102", s)
+	if err != nil {
+		dt, err = time.Parse("2006-01-02", s)
+	}
+	return
+}
 
-	// drain the channel, there are 4 tasks to wait for
-	for i := 0; i < 4; i++ {
-		task := <-ch // wait for one task to complete
-		fmt.Println(task + " done")
+// parseDt returns the last day of an interaction record, or nil when there isn't one.
+func parseDt(record map[string]string) (lastDt interface{}, err error) {
+	dt, err := parseDay(record["last_dt"])
+	if err != nil {
+		err = fmt.Errorf("last_dt %q isn't yyyymmdd or yyyy-mm-dd", record["last_dt"])
+		return
 	}
+	if !dt.IsZero() {
+		lastDt = dt
+	}
+	return
 }
 
-func LoadUserProductViews(db *sql.DB, ch chan string) {
-	var trans *sql.Tx
-	var stmt *sql.Stmt
-	var err error
+// a loadResult is what a loader sends back once it's done, err is why it stopped if it failed
+type loadResult struct {
+	task string
+	err  error
+}
 
-	fmt.Println("loading user product views")
+// LoadAllData validates the data files and loads the rows that pass. If any file rejects more
+// than maxRejectRate of its rows, or the schema is out of date, nothing is loaded. Cancelling
+// the context stops the loaders after their current batch, leaving the tables part loaded.
+func LoadAllData(ctx context.Context, maxRejectRate float64) (err error) {
+	db := OpenDB()
+	defer db.Close()
 
-	trans, err = db.Begin()
+	err = CheckSchema(ctx, db)
 	if err != nil {
-		panic(err)
+		return
 	}
 
-	err = deleteAllUserProductViews(trans)
+	validated := ValidateAllData()
+	reports := make(map[string]*FileReport)
+	for _, report := range validated {
+		reports[report.Name] = report
+	}
+	err = checkRejectRates(validated, maxRejectRate)
 	if err != nil {
-		panic(err)
+		displayReports(reports)
+		return
 	}
 
-	file := openDataFile("user_products_viewed.txt")
-	defer file.Close()
+	if ctx.Err() != nil {
+		fmt.Println("interrupted, nothing loaded")
+		return ctx.Err()
+	}
+
+	ch := make(chan *loadResult, 10)
+	tasks := 0
+	load := func(task string, report *FileReport,
+		loader func(context.Context, *sql.DB, *FileReport) error) {
+
+		tasks += 1
+		go func() {
+			ch <- &loadResult{task: task, err: loader(ctx, db, report)}
+		}()
+	}
+
+	load("products", reports["products"], LoadProducts)
+	load("user product views", reports["user_products_viewed"], LoadUserProductViews)
+	load("user product purchases", reports["user_products_purchased"], LoadUserProductPurchases)
+
+	// conversion rates can be computed once the views and purchases are loaded instead
+	if findDataFile(dataFilenames("global_conversion_rate")...) != "" {
+		load("product conversion rates", reports["global_conversion_rate"],
+			LoadProductConversionRates)
+	} else {
+		fmt.Println("no conversion rates to load, compute them with -conversion")
+	}
+
+	// the event stream is optional, older extracts only have the aggregates
+	if findEventFile() != "" {
+		load("user product events", reports["user_product_events"], LoadUserProductEvents)
+	}
+
+	// drain the channel, waiting for every task even once one has failed
+	for i := 0; i < tasks; i++ {
+		result := <-ch // wait for one task to complete
+		if result.err != nil {
+			fmt.Printf("%s failed: %v\n", result.task, result.err)
+			if err == nil {
+				err = result.err
+			}
+			continue
+		}
+		fmt.Println(result.task + " done")
+	}
+
+	displayReports(reports)
+	return
+}
 
-	stmt = getInsertUserProductViewStmt(trans)
-	defer stmt.Close()
+// checkRejectRates returns an error for the first file that rejected more than maxRejectRate
+// of its rows.
+func checkRejectRates(reports []*FileReport, maxRejectRate float64) (err error) {
+	for _, report := range reports {
+		if report.RejectRate() > maxRejectRate {
+			err = fmt.Errorf("%s rejected %.1f%% of its rows, not loading", report.Filename,
+				report.RejectRate()*100.0)
+			return
+		}
+	}
+	return
+}
 
-	tabReader := getTabReader(file)
+func displayReports(reports map[string]*FileReport) {
+	names := make([]string, 0)
+	for name, _ := range reports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
 
-	c := 0
+	fmt.Println("********** LOAD SUMMARY **********")
+	for _, name := range names {
+		fmt.Println(reports[name].String())
+	}
+}
+
+func LoadUserProductViews(ctx context.Context, db *sql.DB, report *FileReport) (err error) {
+	fmt.Println("loading user product views")
+
+	err = deleteAll(ctx, db, deleteAllUserProductViews)
+	if err != nil {
+		return
+	}
+
+	file, reader := openRecords("user_products_viewed", userProductColumns)
+	defer file.Close()
+
+	writer := newBulkWriter(ctx, db, "user_product_views", "account_id", "monetate_id", "pid", "count",
+		"last_dt")
 
 	for {
-		record, err := tabReader.Read()
+		record, err := reader.Read()
 		if err == io.EOF {
 			break
-		} else if err == nil {
-			if c%10000 == 0 {
-				trans.Commit()
-				stmt.Close()
-
-				trans, err = db.Begin()
-				if err != nil {
-					panic(err)
-				}
-				stmt = getInsertUserProductViewStmt(trans)
-			}
-		} else {
-			panic(err)
+		} else if report.rejects(reader.Line()) {
+			continue
+		} else if err != nil {
+			return err
 		}
 
-		accountId, err := strconv.ParseInt(record[0], 10, 32)
+		accountId, err := strconv.ParseInt(record["account_id"], 10, 32)
 		if err != nil {
-			panic(err)
+			return err
 		}
-		count, err := strconv.ParseInt(record[3], 10, 32)
+		count, err := strconv.ParseInt(record["count"], 10, 32)
 		if err != nil {
-			panic(err)
+			return err
 		}
-
-		err = insertUserProduct(stmt, accountId, record[1], record[2], count)
+		lastDt, err := parseDt(record)
 		if err != nil {
-			panic(err)
+			return err
 		}
 
-		c += 1
+		err = writer.add(accountId, record["monetate_id"], record["pid"], count, lastDt)
+		if err != nil {
+			return err
+		}
 	}
 
-	trans.Commit()
-
-	ch <- "user product views" // signal that we're done
+	_, err = writer.close()
+	return
 }
 
-func LoadUserProductPurchases(db *sql.DB, ch chan string) {
-	var trans *sql.Tx
-	var stmt *sql.Stmt
-	var err error
-
+func LoadUserProductPurchases(ctx context.Context, db *sql.DB, report *FileReport) (err error) {
 	fmt.Println("loading user product purchases")
-	trans, err = db.Begin()
-	if err != nil {
-		panic(err)
-	}
 
-	err = deleteAllUserProductPurchases(trans)
+	err = deleteAll(ctx, db, deleteAllUserProductPurchases)
 	if err != nil {
-		panic(err)
+		return
 	}
 
-	file := openDataFile("user_products_purchased.txt")
+	file, reader := openRecords("user_products_purchased", userProductColumns)
 	defer file.Close()
 
-	stmt = getInsertUserProductPurchaseStmt(trans)
-	defer stmt.Close()
-
-	tabReader := getTabReader(file)
-
-	c := 0
+	writer := newBulkWriter(ctx, db, "user_product_purchases", "account_id", "monetate_id", "pid",
+		"count", "last_dt")
 
 	for {
-		record, err := tabReader.Read()
+		record, err := reader.Read()
 		if err == io.EOF {
 			break
-		} else if err == nil {
-			if c%10000 == 0 {
-				trans.Commit()
-				stmt.Close()
-
-				trans, err = db.Begin()
-				if err != nil {
-					panic(err)
-				}
-				stmt = getInsertUserProductPurchaseStmt(trans)
-			}
-		} else {
-			panic(err)
+		} else if report.rejects(reader.Line()) {
+			continue
+		} else if err != nil {
+			return err
 		}
 
-		accountId, err := strconv.ParseInt(record[0], 10, 32)
+		accountId, err := strconv.ParseInt(record["account_id"], 10, 32)
 		if err != nil {
-			panic(err)
+			return err
 		}
-		count, err := strconv.ParseInt(record[3], 10, 32)
+		count, err := strconv.ParseInt(record["count"], 10, 32)
 		if err != nil {
-			panic(err)
+			return err
 		}
-
-		err = insertUserProduct(stmt, accountId, record[1], record[2], count)
+		lastDt, err := parseDt(record)
 		if err != nil {
-			panic(err)
+			return err
 		}
 
-		c += 1
+		err = writer.add(accountId, record["monetate_id"], record["pid"], count, lastDt)
+		if err != nil {
+			return err
+		}
 	}
 
-	trans.Commit()
-
-	ch <- "user product purchases" // signal that we're done
+	_, err = writer.close()
+	return
 }
 
-func LoadProductConversionRates(db *sql.DB, ch chan string) {
-	var trans *sql.Tx
-	var stmt *sql.Stmt
-	var err error
-
+func LoadProductConversionRates(ctx context.Context, db *sql.DB, report *FileReport) (err error) {
 	fmt.Println("loading product conversion rates")
 
-	trans, err = db.Begin()
+	err = deleteAll(ctx, db, deleteAllProductConversionRates)
 	if err != nil {
-		panic(err)
+		return
 	}
 
-	err = deleteAllProductConversionRates(trans)
-	if err != nil {
-		panic(err)
-	}
-
-	file := openDataFile("global_conversion_rate.txt")
+	file, reader := openRecords("global_conversion_rate", conversionRateColumns)
 	defer file.Close()
 
-	stmt = getInsertProductConversionRateStmt(trans)
-	defer stmt.Close()
-
-	tabReader := getTabReader(file)
-
-	c := 0
+	writer := newBulkWriter(ctx, db, "product_conversion_rate", "account_id", "pid", "conversion_rate")
 
 	for {
-		record, err := tabReader.Read()
+		record, err := reader.Read()
 		if err == io.EOF {
 			break
-		} else if err == nil {
-			if c%10000 == 0 {
-				trans.Commit()
-				stmt.Close()
-
-				trans, err = db.Begin()
-				if err != nil {
-					panic(err)
-				}
-				stmt = getInsertProductConversionRateStmt(trans)
-			}
-		} else {
-			panic(err)
+		} else if report.rejects(reader.Line()) {
+			continue
+		} else if err != nil {
+			return err
 		}
 
-		accountId, err := strconv.ParseInt(record[0], 10, 32)
+		accountId, err := strconv.ParseInt(record["account_id"], 10, 32)
 		if err != nil {
-			panic(err)
+			return err
 		}
-		conversionRate, err := strconv.ParseFloat(record[2], 64)
+		conversionRate, err := strconv.ParseFloat(record["conversion_rate"], 64)
 		if err != nil {
-			panic(err)
+			return err
 		}
 
-		err = insertProductConversionRate(stmt, accountId, record[1], conversionRate)
+		err = writer.add(accountId, record["pid"], conversionRate)
 		if err != nil {
-			panic(err)
+			return err
 		}
-
-		c += 1
 	}
 
-	trans.Commit()
+	_, err = writer.close()
+	return
+}
 
-	ch <- "product conversion rates" // signal that we're done
+// parseMargin sets the product's cost and margin from the record's optional unit_cost or
+// margin, whichever it has. Only csv and json files can have them, by naming the column. A
+// product without either has no cost and no margin.
+func parseMargin(record map[string]string, p *Product) (err error) {
+	switch {
+	case record["unit_cost"] != "":
+		p.UnitCost, err = strconv.ParseFloat(record["unit_cost"], 64)
+		p.Margin = p.UnitPrice - p.UnitCost
+	case record["margin"] != "":
+		p.Margin, err = strconv.ParseFloat(record["margin"], 64)
+		p.UnitCost = p.UnitPrice - p.Margin
+	default:
+		return
+	}
+	if p.UnitPrice > 0.0 {
+		p.MarginRate = p.Margin / p.UnitPrice
+	}
+	return
 }
 
-func LoadProducts(db *sql.DB, ch chan string) {
+func LoadProducts(ctx context.Context, db *sql.DB, report *FileReport) (err error) {
 	fmt.Println("loading products")
 
-	trans, err := db.Begin()
+	err = deleteAll(ctx, db, deleteAllProductCategories, deleteAllProducts)
 	if err != nil {
-		panic(err)
+		return
 	}
 
-	err = deleteAllProducts(trans)
-	if err != nil {
-		panic(err)
-	}
-
-	file := openDataFile("products.txt")
+	file, reader := openRecords("products", productColumns)
 	defer file.Close()
 
-	stmt := getInsertProductStmt(trans)
-	defer stmt.Close()
-
-	tabReader := getTabReader(file)
+	writer := newBulkWriter(ctx, db, "product", "account_id", "pid", "name", "product_url", "image_url",
+		"unit_cost", "unit_price", "margin", "margin_rate")
+	catWriter := newBulkWriter(ctx, db, "product_category", "account_id", "pid", "category_id",
+		"category_name")
 
 	for {
-		record, err := tabReader.Read()
+		record, err := reader.Read()
 		if err == io.EOF {
 			break
+		} else if report.rejects(reader.Line()) {
+			continue
 		} else if err != nil {
-			trans.Rollback()
-			panic(err)
+			return err
 		}
 
-		accountId, err := strconv.ParseInt(record[0], 10, 32)
+		accountId, err := strconv.ParseInt(record["account_id"], 10, 32)
 		if err != nil {
-			trans.Rollback()
-			panic(err)
+			return err
 		}
-		unitPrice, err := strconv.ParseFloat(record[5], 32)
+		unitPrice, err := strconv.ParseFloat(record["unit_price"], 32)
 		if err != nil {
-			trans.Rollback()
-			panic(err)
+			return err
 		}
 
-		p := &Product{AccountId: accountId, Pid: record[1], Name: record[2], ProductUrl: record[3],
-			ImageUrl: record[4], UnitCost: 0.0, UnitPrice: unitPrice, Margin: 0.0,
-			MarginRate: 0.0}
-		err = insertProduct(stmt, p)
+		p := &Product{AccountId: accountId, Pid: record["pid"], Name: record["name"],
+			ProductUrl: record["product_url"], ImageUrl: record["image_url"], UnitPrice: unitPrice}
+		err = parseMargin(record, p)
 		if err != nil {
-			panic(err)
+			return err
+		}
+		err = writer.add(p.AccountId, p.Pid, p.Name, p.ProductUrl, p.ImageUrl, p.UnitCost, p.UnitPrice,
+			p.Margin, p.MarginRate)
+		if err != nil {
+			return err
 		}
-	}
 
-	trans.Commit()
+		// an optional category id and name can follow the price, otherwise the category
+		// comes from the product url
+		if record["category_id"] != "" {
+			p.CategoryId = record["category_id"]
+			p.CategoryName = record["category_name"]
+		} else {
+			p.CategoryId, p.CategoryName = parseCategory(p.ProductUrl)
+		}
+		if p.CategoryId != "" {
+			err = catWriter.add(p.AccountId, p.Pid, p.CategoryId, p.CategoryName)
+			if err != nil {
+				return err
+			}
+		}
+	}
 
-	ch <- "products" // signal that we're done
+	_, err = writer.close()
+	if err != nil {
+		return
+	}
+	_, err = catWriter.close()
+	return
 }
@@ -0,0 +1,422 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the schema, as numbered migrations named like 0002_recommendations.up.sql and a matching
+// .down.sql that undoes it. Where sqlite needs different SQL a 0002_recommendations.sqlite.up.sql
+// is used instead.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+
+	sqliteUp   string
+	sqliteDown string
+}
+
+// statements returns the SQL for migrating up or down in the database OpenDB connects to.
+func (m *Migration) statements(up bool) string {
+	switch {
+	case up && isSQLite() && m.sqliteUp != "":
+		return m.sqliteUp
+	case !up && isSQLite() && m.sqliteDown != "":
+		return m.sqliteDown
+	case up:
+		return m.Up
+	}
+	return m.Down
+}
+
+// MigrationState is a migration and when it was applied, nil if it hasn't been.
+type MigrationState struct {
+	Migration *Migration
+	AppliedAt *time.Time
+}
+
+// getMigrations returns the embedded migrations in version order.
+func getMigrations() (migrations []*Migration, err error) {
+	files, err := fs.Sub(migrationFiles, "migrations")
+	if err != nil {
+		return
+	}
+	migrations, err = readMigrations(files)
+	return
+}
+
+// readMigrations reads every migration in the directory and returns them in version order.
+func readMigrations(files fs.FS) (migrations []*Migration, err error) {
+	entries, err := fs.ReadDir(files, ".")
+	if err != nil {
+		return
+	}
+
+	versions := make(map[int]*Migration)
+	for _, entry := range entries {
+		filename := entry.Name()
+		var direction string
+		switch {
+		case strings.HasSuffix(filename, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(filename, ".down.sql"):
+			direction = "down"
+		default:
+			err = fmt.Errorf("migration %s isn't up or down", filename)
+			return
+		}
+
+		base := strings.TrimSuffix(filename, "."+direction+".sql")
+		sqlite := strings.HasSuffix(base, ".sqlite")
+		base = strings.TrimSuffix(base, ".sqlite")
+		i := strings.Index(base, "_")
+		if i < 0 {
+			err = fmt.Errorf("migration %s has no version", filename)
+			return
+		}
+		var version int
+		version, err = strconv.Atoi(base[:i])
+		if err != nil {
+			err = fmt.Errorf("migration %s has no version", filename)
+			return
+		}
+
+		var contents []byte
+		contents, err = fs.ReadFile(files, filename)
+		if err != nil {
+			err = fmt.Errorf("migration %d: %w", version, err)
+			return
+		}
+
+		m, ok := versions[version]
+		if !ok {
+			m = &Migration{Version: version, Name: base[i+1:]}
+			versions[version] = m
+		} else if m.Name != base[i+1:] {
+			err = fmt.Errorf("two migrations numbered %d, %s and %s", version, m.Name, base[i+1:])
+			return
+		}
+		switch {
+		case sqlite && direction == "up":
+			m.sqliteUp = string(contents)
+		case sqlite:
+			m.sqliteDown = string(contents)
+		case direction == "up":
+			m.Up = string(contents)
+		default:
+			m.Down = string(contents)
+		}
+	}
+
+	migrations = make([]*Migration, 0)
+	for _, m := range versions {
+		if m.Up == "" || m.Down == "" {
+			err = fmt.Errorf("migration %d %s needs both an up and a down", m.Version, m.Name)
+			return
+		}
+		migrations = append(migrations, m)
+	}
+	sort.Sort(byVersion(migrations))
+	return
+}
+
+type byVersion []*Migration
+
+func (a byVersion) Len() int           { return len(a) }
+func (a byVersion) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byVersion) Less(i, j int) bool { return a[i].Version < a[j].Version }
+
+// ensureMigrationsTable creates the schema_migrations table if it's missing. A database
+// created from one of the old db.sql files, before there were migrations, already has some of
+// the migrations' tables and columns, so every migration up to the first one whose tables or
+// columns are missing is recorded as applied.
+func ensureMigrationsTable(ctx context.Context, db *sql.DB,
+	migrations []*Migration) (err error) {
+
+	exists, err := tableExists(ctx, db, "schema_migrations")
+	if err != nil || exists {
+		return
+	}
+
+	trans, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+
+	s := []string{}
+
+	s = append(s, "CREATE TABLE schema_migrations (")
+	s = append(s, "version    INTEGER   NOT NULL,")
+	s = append(s, "name       TEXT      NOT NULL,")
+	s = append(s, "applied_at TIMESTAMP NOT NULL,")
+	s = append(s, "PRIMARY KEY (version))")
+
+	_, err = trans.ExecContext(ctx, strings.Join(s, " "))
+	if err != nil {
+		trans.Rollback()
+		return
+	}
+
+	for _, m := range migrations {
+		var applied bool
+		applied, err = isMigrationApplied(ctx, trans, m)
+		if err != nil {
+			trans.Rollback()
+			err = fmt.Errorf("migration %d %s: %w", m.Version, m.Name, err)
+			return
+		}
+		if !applied {
+			break
+		}
+		fmt.Printf("existing schema found, recording migration %d %s as applied\n", m.Version,
+			m.Name)
+		err = insertSchemaMigration(trans, m)
+		if err != nil {
+			trans.Rollback()
+			err = fmt.Errorf("migration %d %s: %w", m.Version, m.Name, err)
+			return
+		}
+	}
+
+	err = trans.Commit()
+	return
+}
+
+var (
+	createTablePattern = regexp.MustCompile(`(?i)CREATE\s+TABLE\s+(\w+)`)
+	addColumnPattern   = regexp.MustCompile(`(?i)ALTER\s+TABLE\s+(\w+)\s+ADD\s+COLUMN\s+(\w+)`)
+)
+
+// isMigrationApplied reports whether the database already has every table the migration
+// creates and every column it adds. A migration that does neither can't be told, so it isn't.
+func isMigrationApplied(ctx context.Context, trans *sql.Tx, m *Migration) (applied bool,
+	err error) {
+
+	statements := m.statements(true)
+	tables := createTablePattern.FindAllStringSubmatch(statements, -1)
+	columns := addColumnPattern.FindAllStringSubmatch(statements, -1)
+	if len(tables) == 0 && len(columns) == 0 {
+		return
+	}
+
+	for _, match := range tables {
+		applied, err = tableExists(ctx, trans, strings.ToLower(match[1]))
+		if err != nil || !applied {
+			return
+		}
+	}
+	for _, match := range columns {
+		applied, err = columnExists(ctx, trans, strings.ToLower(match[1]),
+			strings.ToLower(match[2]))
+		if err != nil || !applied {
+			return
+		}
+	}
+	return
+}
+
+type queryRower interface {
+	QueryRowContext(context.Context, string, ...interface{}) *sql.Row
+}
+
+// tableExists reports whether the database has the table.
+func tableExists(ctx context.Context, q queryRower, table string) (exists bool, err error) {
+	query := "SELECT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = $1)"
+	if isSQLite() {
+		query = "SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = $1)"
+	}
+	err = q.QueryRowContext(ctx, query, table).Scan(&exists)
+	return
+}
+
+// columnExists reports whether the database's table has the column.
+func columnExists(ctx context.Context, q queryRower, table string, column string) (exists bool,
+	err error) {
+
+	query := "SELECT EXISTS (SELECT 1 FROM information_schema.columns " +
+		"WHERE table_name = $1 AND column_name = $2)"
+	if isSQLite() {
+		query = "SELECT EXISTS (SELECT 1 FROM pragma_table_info($1) WHERE name = $2)"
+	}
+	err = q.QueryRowContext(ctx, query, table, column).Scan(&exists)
+	return
+}
+
+func insertSchemaMigration(trans *sql.Tx, m *Migration) (err error) {
+	_, err = trans.Exec("INSERT INTO schema_migrations (version, name, applied_at) "+
+		"VALUES ($1, $2, $3)", m.Version, m.Name, time.Now())
+	return
+}
+
+func deleteSchemaMigration(trans *sql.Tx, m *Migration) (err error) {
+	_, err = trans.Exec("DELETE FROM schema_migrations WHERE version = $1", m.Version)
+	return
+}
+
+// QueryMigrationStates returns every migration, applied or not, in version order.
+func QueryMigrationStates(ctx context.Context, db *sql.DB) (states []*MigrationState,
+	err error) {
+
+	migrations, err := getMigrations()
+	if err != nil {
+		return
+	}
+	err = ensureMigrationsTable(ctx, db, migrations)
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, "SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		err = rows.Scan(&version, &appliedAt)
+		if err != nil {
+			return
+		}
+		applied[version] = appliedAt
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return
+	}
+
+	states = make([]*MigrationState, 0)
+	for _, m := range migrations {
+		state := &MigrationState{Migration: m}
+		if appliedAt, ok := applied[m.Version]; ok {
+			state.AppliedAt = &appliedAt
+		}
+		states = append(states, state)
+	}
+	return
+}
+
+// MigrateUp applies every migration that hasn't been, in order, each in its own transaction.
+func MigrateUp(ctx context.Context, db *sql.DB) (err error) {
+	states, err := QueryMigrationStates(ctx, db)
+	if err != nil {
+		return
+	}
+	for _, state := range states {
+		if state.AppliedAt != nil {
+			continue
+		}
+		m := state.Migration
+		fmt.Printf("applying migration %d %s\n", m.Version, m.Name)
+		err = runMigration(ctx, db, m, m.statements(true), insertSchemaMigration)
+		if err != nil {
+			err = fmt.Errorf("migration %d %s: %w", m.Version, m.Name, err)
+			return
+		}
+	}
+	return
+}
+
+// MigrateDown reverts the most recently applied migration.
+func MigrateDown(ctx context.Context, db *sql.DB) (err error) {
+	states, err := QueryMigrationStates(ctx, db)
+	if err != nil {
+		return
+	}
+	for i := len(states) - 1; i >= 0; i-- {
+		if states[i].AppliedAt == nil {
+			continue
+		}
+		m := states[i].Migration
+		fmt.Printf("reverting migration %d %s\n", m.Version, m.Name)
+		err = runMigration(ctx, db, m, m.statements(false), deleteSchemaMigration)
+		if err != nil {
+			err = fmt.Errorf("migration %d %s: %w", m.Version, m.Name, err)
+		}
+		return
+	}
+	fmt.Println("no migrations to revert")
+	return
+}
+
+// runMigration applies or reverts the migration, rolling back if the context is cancelled
+// part way through.
+func runMigration(ctx context.Context, db *sql.DB, m *Migration, statements string,
+	record func(*sql.Tx, *Migration) error) (err error) {
+
+	trans, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+
+	_, err = trans.ExecContext(ctx, statements)
+	if err != nil {
+		trans.Rollback()
+		return
+	}
+
+	err = record(trans, m)
+	if err != nil {
+		trans.Rollback()
+		return
+	}
+
+	err = trans.Commit()
+	return
+}
+
+// DisplayMigrationStatus prints every migration and when it was applied.
+func DisplayMigrationStatus(ctx context.Context, db *sql.DB) (err error) {
+	states, err := QueryMigrationStates(ctx, db)
+	if err != nil {
+		return
+	}
+	for _, state := range states {
+		applied := "pending"
+		if state.AppliedAt != nil {
+			applied = state.AppliedAt.Format("2006-01-02 15:04:05")
+		}
+		fmt.Printf("%04d %-32s %s\n", state.Migration.Version, state.Migration.Name, applied)
+	}
+	return
+}
+
+// CheckSchema returns an error unless every migration has been applied.
+func CheckSchema(ctx context.Context, db *sql.DB) (err error) {
+	states, err := QueryMigrationStates(ctx, db)
+	if err != nil {
+		return
+	}
+	pending := make([]string, 0)
+	for _, state := range states {
+		if state.AppliedAt == nil {
+			pending = append(pending, fmt.Sprintf("%d %s", state.Migration.Version,
+				state.Migration.Name))
+		}
+	}
+	if len(pending) > 0 {
+		err = fmt.Errorf("the schema is out of date, run -migrate up to apply: %s",
+			strings.Join(pending, ", "))
+	}
+	return
+}
@@ -0,0 +1,205 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// openTestDB points OpenDB at a new sqlite database, migrated unless it's told not to be, and
+// points it back when the test is done.
+func openTestDB(t *testing.T, migrated bool) (db *sql.DB) {
+	dsn := DSN
+	DSN = filepath.Join(t.TempDir(), "recogen.db")
+	t.Cleanup(func() { DSN = dsn })
+
+	db = OpenDB()
+	t.Cleanup(func() { db.Close() })
+	if migrated {
+		err := MigrateUp(context.Background(), db)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return
+}
+
+func testExec(t *testing.T, db *sql.DB, query string, args ...interface{}) {
+	_, err := db.Exec(query, args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func migrationFS(filenames ...string) fstest.MapFS {
+	files := fstest.MapFS{}
+	for _, filename := range filenames {
+		files[filename] = &fstest.MapFile{Data: []byte("SELECT 1;")}
+	}
+	return files
+}
+
+func TestReadMigrations(t *testing.T) {
+	tests := []struct {
+		name     string
+		files    fstest.MapFS
+		versions []int
+		err      string
+	}{
+		{"in version order", migrationFS("0010_ten.up.sql", "0010_ten.down.sql", "0002_two.up.sql",
+			"0002_two.down.sql", "0001_one.up.sql", "0001_one.down.sql"), []int{1, 2, 10}, ""},
+		{"sqlite variant", migrationFS("0001_one.up.sql", "0001_one.sqlite.up.sql",
+			"0001_one.down.sql"), []int{1}, ""},
+		{"nothing", migrationFS(), []int{}, ""},
+		{"duplicate version", migrationFS("0002_two.up.sql", "0002_two.down.sql",
+			"0002_deux.up.sql", "0002_deux.down.sql"), nil, "two migrations numbered 2"},
+		{"missing down", migrationFS("0001_one.up.sql", "0001_one.down.sql", "0002_two.up.sql"),
+			nil, "migration 2 two needs both an up and a down"},
+		{"missing up", migrationFS("0003_three.down.sql"), nil,
+			"migration 3 three needs both an up and a down"},
+		{"sqlite up isn't an up", migrationFS("0001_one.sqlite.up.sql", "0001_one.down.sql"), nil,
+			"migration 1 one needs both an up and a down"},
+		{"not up or down", migrationFS("0001_one.sql"), nil, "isn't up or down"},
+		{"no version", migrationFS("one.up.sql"), nil, "has no version"},
+		{"version isn't a number", migrationFS("first_one.up.sql"), nil, "has no version"},
+	}
+
+	for _, test := range tests {
+		migrations, err := readMigrations(test.files)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		versions := make([]int, 0)
+		for _, m := range migrations {
+			versions = append(versions, m.Version)
+		}
+		if len(versions) != len(test.versions) {
+			t.Errorf("%s: got versions %v, want %v", test.name, versions, test.versions)
+			continue
+		}
+		for i := range versions {
+			if versions[i] != test.versions[i] {
+				t.Errorf("%s: got versions %v, want %v", test.name, versions, test.versions)
+				break
+			}
+		}
+	}
+}
+
+func TestEmbeddedMigrations(t *testing.T) {
+	migrations, err := getMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Errorf("migration %s is numbered %d, want %d", m.Name, m.Version, i+1)
+		}
+	}
+}
+
+func countPending(t *testing.T, db *sql.DB) (pending int) {
+	states, err := QueryMigrationStates(context.Background(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, state := range states {
+		if state.AppliedAt == nil {
+			pending += 1
+		}
+	}
+	return
+}
+
+func TestMigrateUpAndDown(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t, true)
+	migrations, err := getMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pending := countPending(t, db); pending != 0 {
+		t.Fatalf("%d migrations pending after migrating up", pending)
+	}
+	err = CheckSchema(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range migrations {
+		err = MigrateDown(ctx, db)
+		if err != nil {
+			t.Fatalf("reverting %d: %v", len(migrations)-i, err)
+		}
+		if pending := countPending(t, db); pending != i+1 {
+			t.Fatalf("%d migrations pending after %d reverted", pending, i+1)
+		}
+	}
+	if CheckSchema(ctx, db) == nil {
+		t.Error("the schema checks out with every migration reverted")
+	}
+	err = MigrateDown(ctx, db)
+	if err != nil {
+		t.Errorf("reverting with nothing applied: %v", err)
+	}
+
+	err = MigrateUp(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending := countPending(t, db); pending != 0 {
+		t.Errorf("%d migrations pending after migrating back up", pending)
+	}
+}
+
+func TestMigrateUpNamesTheFailingMigration(t *testing.T) {
+	db := openTestDB(t, false)
+	// a table migration 3 creates, in the way of it but not of 1 and 2
+	testExec(t, db, "CREATE TABLE schema_migrations (version INTEGER NOT NULL, "+
+		"name TEXT NOT NULL, applied_at TIMESTAMP NOT NULL, PRIMARY KEY (version))")
+	testExec(t, db, "CREATE TABLE product_category (pid TEXT)")
+
+	err := MigrateUp(context.Background(), db)
+	if err == nil || !strings.HasPrefix(err.Error(), "migration 3 product_category: ") {
+		t.Fatalf("got %v, want migration 3 to fail", err)
+	}
+	migrations, err := getMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending := countPending(t, db); pending != len(migrations)-2 {
+		t.Errorf("%d migrations pending, want the failed one and those after it", pending)
+	}
+}
+
+func TestBaselineExistingSchema(t *testing.T) {
+	db := openTestDB(t, false)
+	migrations, err := getMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the tables of the original db.sql, which is what migration 1 creates
+	_, err = db.Exec(migrations[0].statements(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pending := countPending(t, db); pending != len(migrations)-1 {
+		t.Fatalf("%d migrations pending, want all but the first", pending)
+	}
+	err = MigrateUp(context.Background(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,4 @@
+DROP TABLE product;
+DROP TABLE product_conversion_rate;
+DROP TABLE user_product_purchases;
+DROP TABLE user_product_views;
@@ -0,0 +1,2 @@
+DROP TABLE recommendation;
+DROP TABLE recommendation_run;
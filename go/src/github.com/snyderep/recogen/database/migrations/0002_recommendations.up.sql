@@ -0,0 +1,31 @@
+-- scorer to rules are the settings the run was made with, weights and rules are JSON and rules
+-- is empty if the account had none
+CREATE TABLE recommendation_run (
+    run_id          SERIAL      NOT NULL,
+    account_id      INTEGER     NOT NULL,
+    monetate_id     TEXT        NOT NULL,
+    max_population  INTEGER     NOT NULL,
+    max_generations INTEGER     NOT NULL,
+    score           FLOAT       NOT NULL,
+    started_at      TIMESTAMP   NOT NULL,
+    finished_at     TIMESTAMP   NOT NULL,
+    scorer          TEXT        NOT NULL,
+    top_k           INTEGER     NOT NULL,
+    weights         TEXT        NOT NULL,
+    half_life       FLOAT       NOT NULL,
+    rules           TEXT        NOT NULL,
+    PRIMARY KEY (run_id)
+);
+CREATE INDEX recommendation_run_ak1 ON recommendation_run (account_id, monetate_id, finished_at);
+
+CREATE TABLE recommendation (
+    run_id       INTEGER   NOT NULL REFERENCES recommendation_run (run_id),
+    account_id   INTEGER   NOT NULL,
+    monetate_id  TEXT      NOT NULL,
+    pid          TEXT      NOT NULL,
+    rank         INTEGER   NOT NULL,
+    score        FLOAT     NOT NULL,
+    generated_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (run_id, pid)
+);
+CREATE INDEX recommendation_ak1 ON recommendation (account_id, monetate_id, generated_at);
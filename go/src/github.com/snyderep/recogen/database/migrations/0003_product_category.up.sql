@@ -0,0 +1,8 @@
+CREATE TABLE product_category (
+    account_id    INTEGER NOT NULL,
+    pid           TEXT    NOT NULL,
+    category_id   TEXT    NOT NULL,
+    category_name TEXT    NULL,
+    PRIMARY KEY (account_id, pid)
+);
+CREATE INDEX product_category_ak1 ON product_category (account_id, category_id);
@@ -0,0 +1,11 @@
+-- precomputed item to item co-occurrence, source is 'view' or 'purchase'
+CREATE TABLE product_cooccurrence (
+    account_id INTEGER NOT NULL,
+    source     TEXT    NOT NULL,
+    pid        TEXT    NOT NULL,
+    other_pid  TEXT    NOT NULL,
+    count      INTEGER NOT NULL,
+    jaccard    FLOAT   NOT NULL,
+    lift       FLOAT   NOT NULL,
+    PRIMARY KEY (account_id, source, pid, other_pid)
+);
@@ -0,0 +1,2 @@
+ALTER TABLE user_product_purchases DROP COLUMN last_dt;
+ALTER TABLE user_product_views DROP COLUMN last_dt;
@@ -0,0 +1,3 @@
+-- the day of the most recent interaction, for decaying old ones
+ALTER TABLE user_product_views ADD COLUMN last_dt DATE NULL;
+ALTER TABLE user_product_purchases ADD COLUMN last_dt DATE NULL;
@@ -0,0 +1,11 @@
+-- individual interactions in the order they happened, event_type is 'view', 'add_to_cart',
+-- 'purchase' or 'wishlist'
+CREATE TABLE user_product_event (
+    account_id  INTEGER   NOT NULL,
+    monetate_id TEXT      NOT NULL,
+    pid         TEXT      NOT NULL,
+    event_type  TEXT      NOT NULL,
+    event_time  TIMESTAMP NOT NULL,
+    PRIMARY KEY (account_id, monetate_id, event_time, pid, event_type)
+);
+CREATE INDEX user_product_event_ak1 ON user_product_event (account_id, pid);
@@ -0,0 +1 @@
+DROP TABLE product_conversion_rate_build;
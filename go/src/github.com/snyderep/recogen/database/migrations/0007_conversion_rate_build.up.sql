@@ -0,0 +1,8 @@
+-- the accounts whose conversion rates were computed from their views and purchases, rather
+-- than loaded, and the prior they were smoothed with
+CREATE TABLE product_conversion_rate_build (
+    account_id  INTEGER   NOT NULL,
+    prior_views FLOAT     NOT NULL,
+    built_at    TIMESTAMP NOT NULL,
+    PRIMARY KEY (account_id)
+);
@@ -1,15 +1,22 @@
 package database
 
+import (
+	"time"
+)
+
 type Product struct {
-	AccountId  int64
-	Pid        string
-	Name       string
-	ProductUrl string
-	ImageUrl   string
-	UnitCost   float64
-	UnitPrice  float64
-	Margin     float64
-	MarginRate float64
+	AccountId  int64   `json:"account_id"`
+	Pid        string  `json:"pid"`
+	Name       string  `json:"name"`
+	ProductUrl string  `json:"product_url"`
+	ImageUrl   string  `json:"image_url"`
+	UnitCost   float64 `json:"unit_cost"`
+	UnitPrice  float64 `json:"unit_price"`
+	Margin     float64 `json:"margin"`
+	MarginRate float64 `json:"margin_rate"`
+
+	CategoryId   string `json:"category_id,omitempty"`
+	CategoryName string `json:"category_name,omitempty"`
 }
 func (p *Product) String() string {
 	return "pid: " + p.Pid + "\nname: " + p.Name + "\nurl: " + p.ProductUrl + "\nimage: " + p.ImageUrl
@@ -18,3 +25,29 @@ func (p *Product) String() string {
 type Person struct {
 	MonetateId string
 }
+
+type RecommendationRun struct {
+	RunId          int64
+	AccountId      int64
+	MonetateId     string
+	MaxPopulation  int
+	MaxGenerations int
+	Score          float64
+	StartedAt      time.Time
+	FinishedAt     time.Time
+	Scorer         string
+	TopK           int
+	Weights        string // fitness weights as JSON
+	HalfLife       float64
+	Rules          string // the account's rules as JSON, empty if it had none
+}
+
+type Recommendation struct {
+	RunId       int64
+	AccountId   int64
+	MonetateId  string
+	Rank        int
+	Score       float64
+	GeneratedAt time.Time
+	Product     *Product
+}
@@ -0,0 +1,155 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+)
+
+func insertRecommendationRun(ctx context.Context, trans *sql.Tx,
+	run *RecommendationRun) (err error) {
+
+	s := []string{}
+
+	s = append(s, "INSERT INTO recommendation_run (account_id, monetate_id, max_population,")
+	s = append(s, "max_generations, score, started_at, finished_at, scorer, top_k, weights,")
+	s = append(s, "half_life, rules)")
+	s = append(s, "VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)")
+	s = append(s, "RETURNING run_id")
+
+	query := strings.Join(s, " ")
+
+	row := trans.QueryRowContext(ctx, query, run.AccountId, run.MonetateId, run.MaxPopulation,
+		run.MaxGenerations, run.Score, run.StartedAt, run.FinishedAt, run.Scorer, run.TopK,
+		run.Weights, run.HalfLife, run.Rules)
+	err = row.Scan(&run.RunId)
+	return
+}
+
+func getInsertRecommendationStmt(ctx context.Context, trans *sql.Tx) (stmt *sql.Stmt,
+	err error) {
+
+	// note that postgresql uses $1, $2, etc while others use ?
+	s := "INSERT INTO recommendation (run_id, account_id, monetate_id, pid, rank, score, " +
+		"generated_at) VALUES ($1, $2, $3, $4, $5, $6, $7)"
+	stmt, err = trans.PrepareContext(ctx, s)
+	return
+}
+
+func insertRecommendation(ctx context.Context, stmt *sql.Stmt, r *Recommendation) (err error) {
+	_, err = stmt.ExecContext(ctx, r.RunId, r.AccountId, r.MonetateId, r.Product.Pid, r.Rank,
+		r.Score, r.GeneratedAt)
+	return
+}
+
+// SaveRecommendations writes the run and its recommendations in a single transaction.
+// The run id assigned by the database is set on the run and on every recommendation.
+func SaveRecommendations(ctx context.Context, db *sql.DB, run *RecommendationRun,
+	recos []*Recommendation) (err error) {
+
+	trans, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+
+	err = insertRecommendationRun(ctx, trans, run)
+	if err != nil {
+		trans.Rollback()
+		return
+	}
+
+	stmt, err := getInsertRecommendationStmt(ctx, trans)
+	if err != nil {
+		trans.Rollback()
+		return
+	}
+	defer stmt.Close()
+
+	for _, r := range recos {
+		r.RunId = run.RunId
+		err = insertRecommendation(ctx, stmt, r)
+		if err != nil {
+			trans.Rollback()
+			return
+		}
+	}
+
+	err = trans.Commit()
+	return
+}
+
+// QueryLatestRecommendations returns the recommendations from the most recent run for the
+// person, in rank order. The run is nil if the person has never had recommendations saved.
+func QueryLatestRecommendations(ctx context.Context, db *sql.DB, accountId int64,
+	person *Person) (run *RecommendationRun, recos []*Recommendation, err error) {
+
+	ctx, cancel := withQueryTimeout(ctx)
+	defer cancel()
+
+	s := []string{}
+
+	s = append(s, "SELECT run_id, account_id, monetate_id, max_population, max_generations,")
+	s = append(s, "score, started_at, finished_at, scorer, top_k, weights, half_life, rules")
+	s = append(s, "FROM recommendation_run")
+	s = append(s, "WHERE account_id = $1 AND monetate_id = $2")
+	s = append(s, "ORDER BY finished_at DESC, run_id DESC")
+	s = append(s, "LIMIT 1")
+
+	query := strings.Join(s, " ")
+
+	row := db.QueryRowContext(ctx, query, accountId, person.MonetateId)
+	run = &RecommendationRun{}
+	err = row.Scan(&run.RunId, &run.AccountId, &run.MonetateId, &run.MaxPopulation,
+		&run.MaxGenerations, &run.Score, &run.StartedAt, &run.FinishedAt, &run.Scorer, &run.TopK,
+		&run.Weights, &run.HalfLife, &run.Rules)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			run = nil
+			recos = make([]*Recommendation, 0)
+			err = nil
+		}
+		return
+	}
+
+	s = []string{}
+
+	s = append(s, "SELECT r.run_id, r.account_id, r.monetate_id, r.rank, r.score, r.generated_at,")
+	s = append(s, "p.account_id, p.pid, p.name, p.product_url, p.image_url, p.unit_cost,")
+	s = append(s, "p.unit_price, p.margin, p.margin_rate,")
+	s = append(s, "COALESCE(pc.category_id, ''), COALESCE(pc.category_name, '')")
+	s = append(s, "FROM recommendation r JOIN product p ON (")
+	s = append(s, "r.account_id = p.account_id AND")
+	s = append(s, "r.pid = p.pid)")
+	s = append(s, "LEFT JOIN product_category pc ON (p.account_id = pc.account_id AND p.pid = pc.pid)")
+	s = append(s, "WHERE r.run_id = $1")
+	s = append(s, "ORDER BY r.rank")
+
+	query = strings.Join(s, " ")
+
+	rows, err := db.QueryContext(ctx, query, run.RunId)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	recos = make([]*Recommendation, 0)
+
+	for rows.Next() {
+		r := &Recommendation{Product: &Product{}}
+		p := r.Product
+		err = rows.Scan(&r.RunId, &r.AccountId, &r.MonetateId, &r.Rank, &r.Score, &r.GeneratedAt,
+			&p.AccountId, &p.Pid, &p.Name, &p.ProductUrl, &p.ImageUrl, &p.UnitCost,
+			&p.UnitPrice, &p.Margin, &p.MarginRate, &p.CategoryId, &p.CategoryName)
+		if err != nil {
+			return
+		}
+		recos = append(recos, r)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return
+	}
+
+	return
+}
@@ -0,0 +1,174 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// the longest line a json data file can have
+const maxJsonLine = 16 * 1024 * 1024
+
+// A recordReader reads one record at a time from a data file, with the fields keyed by
+// column name. It returns io.EOF once the records run out. Line is the line number of the
+// record last read, or last failed to read.
+type recordReader interface {
+	Read() (map[string]string, error)
+	Line() int
+}
+
+// tabRecordReader reads tab separated files without a header, the columns are positional.
+type tabRecordReader struct {
+	reader  *csv.Reader
+	columns []string
+	line    int
+}
+
+func (r *tabRecordReader) Line() int {
+	return r.line
+}
+
+func (r *tabRecordReader) Read() (record map[string]string, err error) {
+	r.line += 1
+	fields, err := r.reader.Read()
+	if err != nil {
+		return
+	}
+	record = make(map[string]string)
+	for i, field := range fields {
+		if i < len(r.columns) {
+			record[r.columns[i]] = field
+		}
+	}
+	return
+}
+
+// csvRecordReader reads comma separated files whose first line names the columns.
+type csvRecordReader struct {
+	reader  *csv.Reader
+	columns []string
+	line    int
+}
+
+func (r *csvRecordReader) Line() int {
+	return r.line
+}
+
+func (r *csvRecordReader) Read() (record map[string]string, err error) {
+	if r.columns == nil {
+		r.line += 1
+		r.columns, err = r.reader.Read()
+		if err != nil {
+			return
+		}
+		for i, c := range r.columns {
+			r.columns[i] = strings.ToLower(strings.TrimSpace(c))
+		}
+	}
+	r.line += 1
+	fields, err := r.reader.Read()
+	if err != nil {
+		return
+	}
+	record = make(map[string]string)
+	for i, field := range fields {
+		if i < len(r.columns) {
+			record[r.columns[i]] = field
+		}
+	}
+	return
+}
+
+// jsonRecordReader reads one JSON object per line. A line that doesn't parse is returned as a
+// recordError, so the lines after it can still be read.
+type jsonRecordReader struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+// recordError is a record that couldn't be parsed, the reader can carry on past it.
+type recordError struct {
+	err error
+}
+
+func (e *recordError) Error() string {
+	return e.err.Error()
+}
+
+func (r *jsonRecordReader) Line() int {
+	return r.line
+}
+
+func (r *jsonRecordReader) Read() (record map[string]string, err error) {
+	var line []byte
+	for len(line) == 0 {
+		if !r.scanner.Scan() {
+			err = r.scanner.Err()
+			if err == nil {
+				err = io.EOF
+			} else {
+				// the error belongs to the line that couldn't be read
+				r.line += 1
+			}
+			return
+		}
+		r.line += 1
+		line = bytes.TrimSpace(r.scanner.Bytes())
+	}
+
+	raw := make(map[string]interface{})
+	decoder := json.NewDecoder(bytes.NewReader(line))
+	decoder.UseNumber()
+	err = decoder.Decode(&raw)
+	if err == nil && decoder.More() {
+		err = errors.New("more than one value on the line")
+	}
+	if err != nil {
+		err = &recordError{err: err}
+		return
+	}
+	record = make(map[string]string)
+	for key, value := range raw {
+		if value != nil {
+			record[strings.ToLower(key)] = fmt.Sprint(value)
+		}
+	}
+	return
+}
+
+// getRecordReader picks the reader from the file extension: .csv files have a header line,
+// .json and .jsonl files have an object per line, anything else is tab separated in the
+// order given by tabColumns.
+func getRecordReader(file *os.File, tabColumns []string) recordReader {
+	switch strings.ToLower(filepath.Ext(file.Name())) {
+	case ".csv":
+		csvReader := csv.NewReader(bufio.NewReader(file))
+		csvReader.FieldsPerRecord = -1
+		return &csvRecordReader{reader: csvReader}
+	case ".json", ".jsonl":
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), maxJsonLine)
+		return &jsonRecordReader{scanner: scanner}
+	}
+	tabReader := getTabReader(file)
+	tabReader.FieldsPerRecord = -1
+	return &tabRecordReader{reader: tabReader, columns: tabColumns}
+}
+
+// findDataFile returns the first of the named files that exists in the data directory, or
+// an empty string if none of them do.
+func findDataFile(filenames ...string) string {
+	for _, filename := range filenames {
+		if hasDataFile(filename) {
+			return filename
+		}
+	}
+	return ""
+}
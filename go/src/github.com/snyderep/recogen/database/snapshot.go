@@ -0,0 +1,206 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// the tables an evaluation removes held out interactions from
+var interactionTables = []string{"user_product_views", "user_product_purchases",
+	"user_product_event"}
+
+// the tables copied into a postgresql snapshot, the interactions and what's built from them
+var snapshotTables = append(interactionTables, "product_cooccurrence", "product_conversion_rate",
+	"product_conversion_rate_build")
+
+// searchPath is the postgresql search_path of every connection OpenDB opens, empty for the
+// server's default. A snapshot puts its own schema first.
+var searchPath = ""
+
+// Snapshot is a copy of the interaction tables that an evaluation can hide interactions in
+// without touching the real ones. While it's open OpenDB connects to the copy, which is thrown
+// away by Close. With sqlite the whole database is copied to a temporary file, with postgresql
+// the tables are copied into a schema of their own.
+type Snapshot struct {
+	db *sql.DB
+
+	dsn    string // what DSN was before the snapshot was opened
+	path   string // the sqlite copy
+	schema string // the postgresql schema holding the copies
+}
+
+// OpenSnapshot copies the interaction tables and points OpenDB at the copies.
+func OpenSnapshot(ctx context.Context) (snap *Snapshot, err error) {
+	snap = &Snapshot{dsn: DSN}
+
+	db := OpenDB()
+	defer db.Close()
+
+	if isSQLite() {
+		var dir string
+		dir, err = os.MkdirTemp("", "recogen-evaluation")
+		if err != nil {
+			return
+		}
+		snap.path = filepath.Join(dir, "snapshot.db")
+		_, err = db.ExecContext(ctx, "VACUUM INTO $1", snap.path)
+		if err != nil {
+			os.RemoveAll(dir)
+			return
+		}
+		DSN = snap.path
+	} else {
+		snap.schema = fmt.Sprintf("recogen_evaluation_%d", os.Getpid())
+		err = createSnapshotSchema(ctx, db, snap.schema)
+		if err != nil {
+			return
+		}
+		searchPath = snap.schema + ", public"
+	}
+
+	fmt.Println("evaluating against a snapshot of the interactions")
+	snap.db = OpenDB()
+	return
+}
+
+func createSnapshotSchema(ctx context.Context, db *sql.DB, schema string) (err error) {
+	trans, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+
+	statements := []string{"CREATE SCHEMA " + schema}
+	for _, table := range snapshotTables {
+		statements = append(statements,
+			fmt.Sprintf("CREATE TABLE %s.%s (LIKE %s INCLUDING ALL)", schema, table, table),
+			fmt.Sprintf("INSERT INTO %s.%s SELECT * FROM %s", schema, table, table))
+	}
+	for _, statement := range statements {
+		_, err = trans.ExecContext(ctx, statement)
+		if err != nil {
+			trans.Rollback()
+			return
+		}
+	}
+
+	err = trans.Commit()
+	return
+}
+
+// Close points OpenDB back at the real tables and throws the copies away.
+func (snap *Snapshot) Close() (err error) {
+	snap.db.Close()
+
+	if snap.path != "" {
+		DSN = snap.dsn
+		err = os.RemoveAll(filepath.Dir(snap.path))
+		return
+	}
+
+	searchPath = ""
+	db := OpenDB()
+	defer db.Close()
+	_, err = db.Exec("DROP SCHEMA " + snap.schema + " CASCADE")
+	return
+}
+
+// HideInteractions removes every interaction the person had with the products from the
+// snapshot: views, purchases and events of any type.
+func (snap *Snapshot) HideInteractions(ctx context.Context, accountId int64, person *Person,
+	pids []string) (err error) {
+
+	trans, err := snap.db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+
+	for _, table := range interactionTables {
+		var stmt *sql.Stmt
+		stmt, err = trans.PrepareContext(ctx, "DELETE FROM "+table+
+			" WHERE account_id = $1 AND monetate_id = $2 AND pid = $3")
+		if err != nil {
+			trans.Rollback()
+			return
+		}
+		for _, pid := range pids {
+			_, err = stmt.ExecContext(ctx, accountId, person.MonetateId, pid)
+			if err != nil {
+				stmt.Close()
+				trans.Rollback()
+				return
+			}
+		}
+		stmt.Close()
+	}
+
+	err = trans.Commit()
+	return
+}
+
+// HideInteractionsSince removes every interaction of the account's on or after the cutoff day
+// from the snapshot. Views and purchases are only dated by their last day, so a row is removed
+// whole if any of it might be on or after the cutoff.
+func (snap *Snapshot) HideInteractionsSince(ctx context.Context, accountId int64,
+	cutoff time.Time) (err error) {
+
+	trans, err := snap.db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+
+	statements := []string{
+		"DELETE FROM user_product_views WHERE account_id = $1 AND " + onOrAfter("last_dt", cutoff),
+		"DELETE FROM user_product_purchases WHERE account_id = $1 AND " +
+			onOrAfter("last_dt", cutoff),
+		"DELETE FROM user_product_event WHERE account_id = $1 AND " +
+			onOrAfter("event_time", cutoff),
+	}
+	for _, statement := range statements {
+		_, err = trans.ExecContext(ctx, statement, accountId)
+		if err != nil {
+			trans.Rollback()
+			return
+		}
+	}
+
+	err = trans.Commit()
+	return
+}
+
+// RebuildCoOccurrences recomputes the snapshot's co-occurrences without the hidden
+// interactions, if there were any co-occurrences to begin with.
+func (snap *Snapshot) RebuildCoOccurrences(ctx context.Context) (err error) {
+	var built bool
+	err = snap.db.QueryRowContext(ctx,
+		"SELECT EXISTS (SELECT 1 FROM product_cooccurrence)").Scan(&built)
+	if err != nil || !built {
+		return
+	}
+	err = BuildProductCoOccurrences(ctx, snap.db)
+	return
+}
+
+// RebuildConversionRates recomputes the snapshot's conversion rates without the hidden
+// interactions, with the same prior, if the account's rates were computed rather than loaded.
+// Loaded rates come from outside and are left as they are.
+func (snap *Snapshot) RebuildConversionRates(ctx context.Context, accountId int64) (err error) {
+	priorViews, built, err := QueryConversionRatePrior(ctx, snap.db, accountId)
+	if err != nil || !built {
+		return
+	}
+	err = BuildProductConversionRates(ctx, snap.db, priorViews)
+	return
+}
+
+// onOrAfter returns the SQL for a date or time column being on or after the day. Like
+// Decay.weight the day is written into the SQL, so the parameters aren't renumbered.
+func onOrAfter(column string, day time.Time) string {
+	if isSQLite() {
+		return fmt.Sprintf("date(%s) >= '%s'", column, day.Format("2006-01-02"))
+	}
+	return fmt.Sprintf("%s >= DATE '%s'", column, day.Format("2006-01-02"))
+}
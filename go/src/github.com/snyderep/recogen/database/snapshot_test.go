@@ -0,0 +1,66 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+)
+
+func queryRate(t *testing.T, db *sql.DB, pid string) (rate float64) {
+	err := db.QueryRow("SELECT conversion_rate FROM product_conversion_rate "+
+		"WHERE account_id = $1 AND pid = $2", testAccountId, pid).Scan(&rate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// y's purchase of 5 is its only one, with z's view of it computed rates go from 1 to 0 when it's
+// hidden.
+func TestSnapshotRebuildsComputedConversionRates(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name     string
+		computed bool
+		want     float64 // the snapshot's rate of 5 once y's purchase of it is hidden
+	}{
+		{"computed", true, 0.0},
+		{"loaded", false, 0.5},
+	}
+
+	for _, test := range tests {
+		db := openInteractionsDB(t)
+		if test.computed {
+			err := BuildProductConversionRates(ctx, db, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			testExec(t, db, "INSERT INTO product_conversion_rate (account_id, pid, "+
+				"conversion_rate) VALUES ($1, '5', 0.5)", testAccountId)
+		}
+		live := queryRate(t, db, "5")
+
+		snap, err := OpenSnapshot(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = snap.HideInteractions(ctx, testAccountId, &Person{MonetateId: "y"}, []string{"5"})
+		if err == nil {
+			err = snap.RebuildConversionRates(ctx, testAccountId)
+		}
+		if err != nil {
+			snap.Close()
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if got := queryRate(t, snap.db, "5"); got != test.want {
+			t.Errorf("%s: the snapshot's rate is %v, want %v", test.name, got, test.want)
+		}
+		snap.Close()
+
+		if got := queryRate(t, db, "5"); got != live {
+			t.Errorf("%s: the live rate changed from %v to %v", test.name, live, got)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"github.com/mattn/go-sqlite3"
+	"math"
+	"math/rand"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// The sqlite driver runs the same SQL as postgresql. Placeholders are renumbered from $1 to
+// ?1, and the functions sqlite doesn't have are provided in Go. random() is replaced so that,
+// as in postgresql, it returns a float from 0 up to 1.
+const sqliteDriverName = "recogen_sqlite3"
+
+func init() {
+	sql.Register(sqliteDriverName, &sqliteDriver{sqlite3.SQLiteDriver{ConnectHook: registerFuncs}})
+}
+
+func registerFuncs(conn *sqlite3.SQLiteConn) (err error) {
+	funcs := []struct {
+		name string
+		impl interface{}
+		pure bool
+	}{
+		{"random", rand.Float64, false},
+		{"ln", func(x interface{}) float64 { return math.Log(toFloat(x)) }, true},
+		{"power", func(x, y interface{}) float64 { return math.Pow(toFloat(x), toFloat(y)) }, true},
+		{"least", least, true},
+		{"soundex", soundex, true},
+		{"difference", difference, true},
+	}
+	for _, f := range funcs {
+		err = conn.RegisterFunc(f.name, f.impl, f.pure)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+type sqliteDriver struct {
+	sqlite3.SQLiteDriver
+}
+
+func (d *sqliteDriver) Open(dsn string) (driver.Conn, error) {
+	conn, err := d.SQLiteDriver.Open(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &sqliteConn{conn.(*sqlite3.SQLiteConn)}, nil
+}
+
+// sqliteConn rewrites every query before handing it to sqlite.
+type sqliteConn struct {
+	*sqlite3.SQLiteConn
+}
+
+var placeholderPattern = regexp.MustCompile(`\$(\d+)`)
+
+func rebind(query string) string {
+	return placeholderPattern.ReplaceAllString(query, "?$1")
+}
+
+func (c *sqliteConn) Prepare(query string) (driver.Stmt, error) {
+	return c.SQLiteConn.Prepare(rebind(query))
+}
+
+func (c *sqliteConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	return c.SQLiteConn.PrepareContext(ctx, rebind(query))
+}
+
+func (c *sqliteConn) Exec(query string, args []driver.Value) (driver.Result, error) {
+	return c.SQLiteConn.Exec(rebind(query), args)
+}
+
+func (c *sqliteConn) ExecContext(ctx context.Context, query string,
+	args []driver.NamedValue) (driver.Result, error) {
+
+	return c.SQLiteConn.ExecContext(ctx, rebind(query), args)
+}
+
+func (c *sqliteConn) Query(query string, args []driver.Value) (driver.Rows, error) {
+	return c.SQLiteConn.Query(rebind(query), args)
+}
+
+func (c *sqliteConn) QueryContext(ctx context.Context, query string,
+	args []driver.NamedValue) (driver.Rows, error) {
+
+	return c.SQLiteConn.QueryContext(ctx, rebind(query), args)
+}
+
+// toFloat converts a sqlite integer or float, NULL is NaN.
+func toFloat(x interface{}) float64 {
+	switch v := x.(type) {
+	case int64:
+		return float64(v)
+	case float64:
+		return v
+	}
+	return math.NaN()
+}
+
+func least(args ...interface{}) (min interface{}) {
+	for _, arg := range args {
+		if arg == nil {
+			// like postgresql, NULLs are ignored
+			continue
+		}
+		if min == nil || toFloat(arg) < toFloat(min) {
+			min = arg
+		}
+	}
+	return
+}
+
+var soundexCodes = map[rune]byte{
+	'B': '1', 'F': '1', 'P': '1', 'V': '1',
+	'C': '2', 'G': '2', 'J': '2', 'K': '2', 'Q': '2', 'S': '2', 'X': '2', 'Z': '2',
+	'D': '3', 'T': '3',
+	'L': '4',
+	'M': '5', 'N': '5',
+	'R': '6',
+}
+
+// soundex returns the four character American soundex code of the string, as postgresql's
+// fuzzystrmatch does, or an empty string if it has no letters.
+func soundex(x interface{}) string {
+	s, _ := x.(string)
+	code := make([]byte, 0, 4)
+	var last byte
+	for _, r := range strings.ToUpper(s) {
+		if r > unicode.MaxASCII || !unicode.IsLetter(r) {
+			continue
+		}
+		c := soundexCodes[r]
+		if len(code) == 0 {
+			code = append(code, byte(r))
+			last = c
+			continue
+		}
+		if c != 0 && c != last {
+			code = append(code, c)
+			if len(code) == 4 {
+				break
+			}
+		}
+		// H and W don't separate letters with the same code, vowels do
+		if r != 'H' && r != 'W' {
+			last = c
+		}
+	}
+	if len(code) == 0 {
+		return ""
+	}
+	for len(code) < 4 {
+		code = append(code, '0')
+	}
+	return string(code)
+}
+
+// difference is the number of matching characters, from 0 to 4, in the soundex codes of the
+// two strings.
+func difference(a, b interface{}) (matches int) {
+	sa, sb := soundex(a), soundex(b)
+	if sa == "" || sb == "" {
+		return
+	}
+	for i := 0; i < 4; i++ {
+		if sa[i] == sb[i] {
+			matches += 1
+		}
+	}
+	return
+}
+
+// sqlitePath returns the file a sqlite DSN names, or an empty string if the DSN is for
+// postgresql. sqlite DSNs start with sqlite: or end in .db, .sqlite or .sqlite3.
+func sqlitePath(dsn string) string {
+	if strings.HasPrefix(dsn, "sqlite:") {
+		return strings.TrimPrefix(dsn, "sqlite:")
+	}
+	for _, ext := range []string{".db", ".sqlite", ".sqlite3"} {
+		if strings.HasSuffix(dsn, ext) {
+			return dsn
+		}
+	}
+	return ""
+}
+
+func openSQLite(path string) (db *sql.DB, err error) {
+	// the loaders write from several goroutines at once, so writers wait their turn rather
+	// than failing, and readers aren't blocked by them
+	params := "_busy_timeout=30000&_journal_mode=WAL&_txlock=immediate&_foreign_keys=1"
+	if strings.Contains(path, "?") {
+		params = "&" + params
+	} else {
+		params = "?" + params
+	}
+	db, err = sql.Open(sqliteDriverName, fmt.Sprintf("file:%s%s", path, params))
+	return
+}
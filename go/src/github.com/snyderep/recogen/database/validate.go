@@ -0,0 +1,309 @@
+package database
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// FileReport is what the validation pass found in one data file. The loaders skip the lines
+// it rejected.
+type FileReport struct {
+	Name       string
+	Filename   string
+	Rows       int
+	Rejected   int
+	Reasons    map[string]int // rejected rows by reason
+	RejectFile string         // where the rejected rows were written, empty if there were none
+
+	rejectedLines map[int]bool
+}
+
+// rejects reports whether the line was rejected. A nil report rejects nothing.
+func (r *FileReport) rejects(line int) bool {
+	if r == nil {
+		return false
+	}
+	return r.rejectedLines[line]
+}
+
+// RejectRate is the fraction of the file's rows that were rejected.
+func (r *FileReport) RejectRate() float64 {
+	if r.Rows == 0 {
+		return 0.0
+	}
+	return float64(r.Rejected) / float64(r.Rows)
+}
+
+func (r *FileReport) String() string {
+	s := fmt.Sprintf("%s: %d rows, %d loaded, %d rejected", r.Filename, r.Rows, r.Rows-r.Rejected,
+		r.Rejected)
+	reasons := make([]string, 0)
+	for reason, _ := range r.Reasons {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		s += fmt.Sprintf("\n    %7d %s", r.Reasons[reason], reason)
+	}
+	if r.RejectFile != "" {
+		s += "\n    rejected rows written to " + r.RejectFile
+	}
+	return s
+}
+
+// checkRow validates a single record. It returns the record's key, for spotting duplicates,
+// the pid it refers to, if it must be a known product, and why it was rejected, empty if it
+// wasn't.
+type checkRow func(record map[string]string) (key string, pid string, reason string)
+
+// validateFile reads every record in the data file and writes the ones that fail the check to
+// a reject file next to it, along with their line numbers and the reason. Rows that refer to
+// pids missing from knownPids, unless it's nil, and rows repeating an earlier row's key are
+// rejected too. The keys of the accepted rows are returned, as account id and key separated by
+// a tab.
+func validateFile(name string, columns []string, knownPids map[string]bool,
+	check checkRow) (report *FileReport, keys map[string]bool) {
+
+	file, reader := openRecords(name, columns)
+	defer file.Close()
+
+	report = &FileReport{Name: name, Filename: filepath.Base(file.Name()),
+		Reasons: make(map[string]int), rejectedLines: make(map[int]bool)}
+	keys = make(map[string]bool)
+
+	// don't leave the rejects from an earlier load lying around
+	os.Remove(file.Name() + ".rejects")
+
+	var rejectFile *os.File
+	var rejectWriter *csv.Writer
+	reject := func(record map[string]string, reason string) {
+		if rejectFile == nil {
+			var err error
+			report.RejectFile = file.Name() + ".rejects"
+			rejectFile, err = os.Create(report.RejectFile)
+			if err != nil {
+				panic(err)
+			}
+			rejectWriter = csv.NewWriter(rejectFile)
+			rejectWriter.Comma = '\t'
+		}
+		line := reader.Line()
+		report.Rejected += 1
+		report.Reasons[reason] += 1
+		report.rejectedLines[line] = true
+		err := rejectWriter.Write([]string{strconv.Itoa(line), reason, formatRecord(record)})
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		report.Rows += 1
+		if parseErr, ok := err.(*csv.ParseError); ok {
+			reject(record, parseErr.Err.Error())
+			continue
+		} else if recordErr, ok := err.(*recordError); ok {
+			reject(record, recordErr.Error())
+			continue
+		} else if err != nil {
+			// anything else, like a read error, leaves the reader unable to carry on, so it's
+			// the last thing rejected
+			reject(record, err.Error())
+			break
+		}
+
+		key, pid, reason := check(record)
+		accountKey := record["account_id"] + "\t"
+		switch {
+		case reason != "":
+			reject(record, reason)
+		case knownPids != nil && !knownPids[accountKey+pid]:
+			reject(record, "unknown pid")
+		case keys[accountKey+key]:
+			reject(record, "duplicate key")
+		default:
+			keys[accountKey+key] = true
+		}
+	}
+
+	if rejectFile != nil {
+		rejectWriter.Flush()
+		err := rejectWriter.Error()
+		if err != nil {
+			panic(err)
+		}
+		rejectFile.Close()
+	}
+
+	return
+}
+
+// formatRecord writes a record as name=value pairs in column name order.
+func formatRecord(record map[string]string) string {
+	names := make([]string, 0)
+	for name, _ := range record {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fields := make([]string, 0)
+	for _, name := range names {
+		fields = append(fields, name+"="+record[name])
+	}
+	return strings.Join(fields, " ")
+}
+
+// checkRequired returns the reason the record fails if any of the fields are missing or
+// blank, or an empty string.
+func checkRequired(record map[string]string, fields ...string) string {
+	for _, field := range fields {
+		if strings.TrimSpace(record[field]) == "" {
+			return "missing " + field
+		}
+	}
+	return ""
+}
+
+func checkAccountId(record map[string]string) string {
+	_, err := strconv.ParseInt(record["account_id"], 10, 32)
+	if err != nil {
+		return "account_id is not an integer"
+	}
+	return ""
+}
+
+func checkProductRow(record map[string]string) (key string, pid string, reason string) {
+	key = record["pid"]
+	if reason = checkRequired(record, "account_id", "pid", "unit_price"); reason != "" {
+		return
+	}
+	if reason = checkAccountId(record); reason != "" {
+		return
+	}
+	if _, err := strconv.ParseFloat(record["unit_price"], 32); err != nil {
+		reason = "unit_price is not a number"
+		return
+	}
+	for _, field := range []string{"unit_cost", "margin"} {
+		if record[field] == "" {
+			continue
+		}
+		if value, err := strconv.ParseFloat(record[field], 64); err != nil {
+			reason = field + " is not a number"
+			return
+		} else if math.IsNaN(value) || math.IsInf(value, 0) {
+			reason = field + " is not finite"
+			return
+		}
+	}
+	if cost, _ := strconv.ParseFloat(record["unit_cost"], 64); cost < 0.0 {
+		reason = "unit_cost is negative"
+	}
+	return
+}
+
+func checkUserProductRow(record map[string]string) (key string, pid string, reason string) {
+	key = record["monetate_id"] + "\t" + record["pid"]
+	pid = record["pid"]
+	if reason = checkRequired(record, "account_id", "monetate_id", "pid", "count"); reason != "" {
+		return
+	}
+	if reason = checkAccountId(record); reason != "" {
+		return
+	}
+	if count, err := strconv.ParseInt(record["count"], 10, 32); err != nil {
+		reason = "count is not an integer"
+		return
+	} else if count < 1 {
+		reason = "count is not positive"
+		return
+	}
+	if _, err := parseDay(record["last_dt"]); err != nil {
+		reason = "last_dt is not a date"
+	}
+	return
+}
+
+func checkConversionRateRow(record map[string]string) (key string, pid string, reason string) {
+	key = record["pid"]
+	pid = record["pid"]
+	if reason = checkRequired(record, "account_id", "pid", "conversion_rate"); reason != "" {
+		return
+	}
+	if reason = checkAccountId(record); reason != "" {
+		return
+	}
+	if rate, err := strconv.ParseFloat(record["conversion_rate"], 64); err != nil {
+		reason = "conversion_rate is not a number"
+	} else if math.IsNaN(rate) || math.IsInf(rate, 0) {
+		reason = "conversion_rate is not finite"
+	} else if rate < 0.0 {
+		// rates above 1 are fine, they're units sold over views, not orders over views
+		reason = "conversion_rate is negative"
+	}
+	return
+}
+
+func checkEventRow(record map[string]string) (key string, pid string, reason string) {
+	pid = record["pid"]
+	if reason = checkRequired(record, "account_id", "monetate_id", "pid", "event_time",
+		"event_type"); reason != "" {
+		return
+	}
+	if reason = checkAccountId(record); reason != "" {
+		return
+	}
+	eventTime, err := parseEventTime(record["event_time"])
+	if err != nil {
+		reason = "event_time is not a time"
+		return
+	}
+	eventType := normalizeEventType(record["event_type"])
+	if eventType == "" {
+		reason = "unknown event type"
+		return
+	}
+	key = strings.Join([]string{record["monetate_id"], eventTime.String(), pid, eventType}, "\t")
+	return
+}
+
+// ValidateAllData checks every data file, writing the rows that would fail to load to reject
+// files. Products are checked first, so that the other files can be checked for unknown pids.
+func ValidateAllData() (reports []*FileReport) {
+	productReport, knownPids := validateFile("products", productColumns, nil, checkProductRow)
+	reports = append(reports, productReport)
+
+	ch := make(chan *FileReport, 4)
+	validate := func(name string, columns []string, check checkRow) {
+		report, _ := validateFile(name, columns, knownPids, check)
+		ch <- report
+	}
+
+	go validate("user_products_viewed", userProductColumns, checkUserProductRow)
+	go validate("user_products_purchased", userProductColumns, checkUserProductRow)
+	tasks := 2
+	if findDataFile(dataFilenames("global_conversion_rate")...) != "" {
+		go validate("global_conversion_rate", conversionRateColumns, checkConversionRateRow)
+		tasks += 1
+	}
+	if findEventFile() != "" {
+		go validate("user_product_events", eventColumns, checkEventRow)
+		tasks += 1
+	}
+
+	for i := 0; i < tasks; i++ {
+		reports = append(reports, <-ch)
+	}
+
+	return
+}
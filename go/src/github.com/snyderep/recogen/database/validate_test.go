@@ -0,0 +1,204 @@
+package database
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type rowTest struct {
+	name   string
+	record map[string]string
+	reason string
+}
+
+func testRows(t *testing.T, check checkRow, tests []rowTest) {
+	for _, test := range tests {
+		_, _, reason := check(test.record)
+		if reason != test.reason {
+			t.Errorf("%s: got %q, want %q", test.name, reason, test.reason)
+		}
+	}
+}
+
+func TestCheckProductRow(t *testing.T) {
+	testRows(t, checkProductRow, []rowTest{
+		{"fine", map[string]string{"account_id": "321", "pid": "1", "unit_price": "8.50"}, ""},
+		{"no pid", map[string]string{"account_id": "321", "unit_price": "8.50"}, "missing pid"},
+		{"blank price", map[string]string{"account_id": "321", "pid": "1", "unit_price": " "},
+			"missing unit_price"},
+		{"account", map[string]string{"account_id": "x", "pid": "1", "unit_price": "1"},
+			"account_id is not an integer"},
+		{"price", map[string]string{"account_id": "321", "pid": "1", "unit_price": "cheap"},
+			"unit_price is not a number"},
+		{"cost", map[string]string{"account_id": "321", "pid": "1", "unit_price": "1",
+			"unit_cost": "0.4"}, ""},
+		{"cost isn't a number", map[string]string{"account_id": "321", "pid": "1",
+			"unit_price": "1", "unit_cost": "some"}, "unit_cost is not a number"},
+		{"negative cost", map[string]string{"account_id": "321", "pid": "1", "unit_price": "1",
+			"unit_cost": "-0.4"}, "unit_cost is negative"},
+		{"infinite margin", map[string]string{"account_id": "321", "pid": "1",
+			"unit_price": "1", "margin": "+Inf"}, "margin is not finite"},
+		{"negative margin", map[string]string{"account_id": "321", "pid": "1",
+			"unit_price": "1", "margin": "-0.2"}, ""},
+	})
+}
+
+func TestCheckUserProductRow(t *testing.T) {
+	row := func(count string, lastDt string) map[string]string {
+		return map[string]string{"account_id": "321", "monetate_id": "2.1", "pid": "1",
+			"count": count, "last_dt": lastDt}
+	}
+	testRows(t, checkUserProductRow, []rowTest{
+		{"fine", row("3", "20121214"), ""},
+		{"dashed date", row("3", "2012-12-14"), ""},
+		{"no date", row("3", ""), ""},
+		{"no count", row("", ""), "missing count"},
+		{"fractional count", row("1.5", ""), "count is not an integer"},
+		{"zero count", row("0", ""), "count is not positive"},
+		{"bad date", row("1", "14/12/2012"), "last_dt is not a date"},
+		{"no visitor", map[string]string{"account_id": "321", "pid": "1", "count": "1"},
+			"missing monetate_id"},
+	})
+}
+
+func TestCheckConversionRateRow(t *testing.T) {
+	row := func(rate string) map[string]string {
+		return map[string]string{"account_id": "321", "pid": "1", "conversion_rate": rate}
+	}
+	testRows(t, checkConversionRateRow, []rowTest{
+		{"fine", row("0.05"), ""},
+		{"zero", row("0"), ""},
+		{"above one", row("1.25"), ""},
+		{"missing", row(""), "missing conversion_rate"},
+		{"not a number", row("high"), "conversion_rate is not a number"},
+		{"nan", row("NaN"), "conversion_rate is not finite"},
+		{"infinite", row("Inf"), "conversion_rate is not finite"},
+		{"negative", row("-0.1"), "conversion_rate is negative"},
+	})
+}
+
+func TestCheckEventRow(t *testing.T) {
+	row := func(eventTime string, eventType string) map[string]string {
+		return map[string]string{"account_id": "321", "monetate_id": "2.1", "pid": "1",
+			"event_time": eventTime, "event_type": eventType}
+	}
+	testRows(t, checkEventRow, []rowTest{
+		{"fine", row("2012-12-14T10:00:00Z", "view"), ""},
+		{"spelling", row("2012-12-14 10:00:00", "Add-To-Cart"), ""},
+		{"millis", row("1355479200000", "order"), ""},
+		{"bad time", row("yesterday", "view"), "event_time is not a time"},
+		{"bad type", row("2012-12-14T10:00:00Z", "like"), "unknown event type"},
+		{"no type", row("2012-12-14T10:00:00Z", ""), "missing event_type"},
+	})
+}
+
+// useDataDir points the data files at a temporary directory holding the files, and back when
+// the test is done.
+func useDataDir(t *testing.T, files map[string]string) {
+	dir := t.TempDir()
+	for filename, contents := range files {
+		err := os.WriteFile(filepath.Join(dir, filename), []byte(contents), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := dataBasePath
+	dataBasePath = dir
+	t.Cleanup(func() { dataBasePath = path })
+}
+
+func TestValidateFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		filename string
+		contents string
+		rows     int
+		rejected []int // the rejected lines
+		reasons  map[string]int
+	}{
+		{"tab separated", "user_products_viewed.txt",
+			"321\t2.1\t1\t3\t20121214\n" +
+				"321\t2.1\t9\t1\t20121214\n" +
+				"321\t2.1\t1\t2\t20121215\n" +
+				"321\t2.2\t1\tmany\t20121214\n",
+			4, []int{2, 3, 4}, map[string]int{"unknown pid": 1, "duplicate key": 1,
+				"count is not an integer": 1}},
+		{"csv", "user_products_viewed.csv",
+			"pid,count,monetate_id,account_id\n" +
+				"1,3,2.1,321\n" +
+				"2,0,2.1,321\n" +
+				"2,1,2.1,321\n",
+			3, []int{3}, map[string]int{"count is not positive": 1}},
+		{"json lines", "user_products_viewed.jsonl",
+			`{"account_id": 321, "monetate_id": "2.1", "pid": "1", "count": 3}` + "\n" +
+				`{"account_id": 321, "monetate_id": "2.1", "pid": "2", "count": 1` + "\n" +
+				"\n" +
+				`{"account_id": 321, "monetate_id": "2.2", "pid": "2", "count": 1}` + "\n",
+			3, []int{2}, nil},
+	}
+
+	knownPids := map[string]bool{"321\t1": true, "321\t2": true}
+	for _, test := range tests {
+		useDataDir(t, map[string]string{test.filename: test.contents})
+		report, keys := validateFile("user_products_viewed", userProductColumns, knownPids,
+			checkUserProductRow)
+
+		if report.Rows != test.rows || report.Rejected != len(test.rejected) {
+			t.Errorf("%s: %d rows and %d rejected, want %d and %d", test.name, report.Rows,
+				report.Rejected, test.rows, len(test.rejected))
+		}
+		if len(keys) != test.rows-len(test.rejected) {
+			t.Errorf("%s: %d keys for %d accepted rows", test.name, len(keys),
+				test.rows-len(test.rejected))
+		}
+		for _, line := range test.rejected {
+			if !report.rejects(line) {
+				t.Errorf("%s: line %d wasn't rejected", test.name, line)
+			}
+		}
+		for reason, count := range test.reasons {
+			if report.Reasons[reason] != count {
+				t.Errorf("%s: %d rejected as %q, want %d", test.name, report.Reasons[reason],
+					reason, count)
+			}
+		}
+
+		rejects, err := os.ReadFile(report.RejectFile)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		lines := strings.Split(strings.TrimSpace(string(rejects)), "\n")
+		if len(lines) != len(test.rejected) {
+			t.Errorf("%s: %d lines in the reject file, want %d", test.name, len(lines),
+				len(test.rejected))
+		}
+	}
+}
+
+func TestCheckRejectRates(t *testing.T) {
+	report := func(rows int, rejected int) *FileReport {
+		return &FileReport{Filename: "products.txt", Rows: rows, Rejected: rejected}
+	}
+	tests := []struct {
+		name          string
+		reports       []*FileReport
+		maxRejectRate float64
+		fails         bool
+	}{
+		{"nothing rejected", []*FileReport{report(10, 0)}, 0.0, false},
+		{"at the threshold", []*FileReport{report(10, 1), report(4, 0)}, 0.1, false},
+		{"over the threshold", []*FileReport{report(10, 0), report(10, 2)}, 0.1, true},
+		{"everything allowed", []*FileReport{report(10, 10)}, 1.0, false},
+		{"empty file", []*FileReport{report(0, 0)}, 0.0, false},
+	}
+
+	for _, test := range tests {
+		err := checkRejectRates(test.reports, test.maxRejectRate)
+		if (err != nil) != test.fails {
+			t.Errorf("%s: got %v", test.name, err)
+		}
+	}
+}
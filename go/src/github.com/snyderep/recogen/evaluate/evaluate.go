@@ -0,0 +1,230 @@
+// Package evaluate measures how well the recommenders predict purchases that have been
+// hidden from them.
+package evaluate
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/snyderep/recogen/database"
+	"github.com/snyderep/recogen/gene"
+	"github.com/snyderep/recogen/reco"
+	"math"
+	"math/rand"
+	"time"
+)
+
+type Config struct {
+	AccountId      int64
+	Sample         int       // number of people to evaluate
+	K              int       // length of the recommendation list that is scored
+	HoldOut        float64   // fraction of the purchases that is hidden, 1.0 hides them all
+	Split          string    // VisitorSplit or TimeSplit
+	Cutoff         time.Time // first day TimeSplit hides, zero to choose it from HoldOut
+	MaxPopulation  int
+	MaxGenerations int
+	Fallback       time.Duration // also evaluate the evolver falling back after this long, 0 not to
+}
+
+const (
+	// VisitorSplit hides a random HoldOut of each evaluated person's purchases, along with
+	// everything else the person did with those products.
+	VisitorSplit = "visitor"
+	// TimeSplit hides every interaction on or after the cutoff, and asks for the products
+	// each evaluated person went on to purchase.
+	TimeSplit = "time"
+)
+
+// splitPurchases chooses which of the purchased pids to hold out. Unless everything is being
+// held out at least one purchase is left behind so the person still has some history.
+func splitPurchases(pids []string, holdOut float64) (heldOut []string) {
+	n := int(math.Ceil(float64(len(pids)) * holdOut))
+	if holdOut < 1.0 && n >= len(pids) {
+		n = len(pids) - 1
+	}
+
+	heldOut = make([]string, 0)
+	for _, i := range rand.Perm(len(pids))[:n] {
+		heldOut = append(heldOut, pids[i])
+	}
+	return
+}
+
+// Run evaluates the genetic recommender and the baselines against the same held out
+// purchases and prints a report. The held out interactions are only hidden in a snapshot of
+// the interaction tables, which every recommender reads from until the evaluation is done. If
+// any of the recommenders fail, including the context being cancelled, the report covers the
+// people evaluated up to then and the error is returned.
+func Run(ctx context.Context, cfg *Config) (results []*Metrics, err error) {
+	evolver := &gene.Evolver{Config: gene.Config{MaxPopulation: cfg.MaxPopulation,
+		MaxGenerations: cfg.MaxGenerations}}
+	recommenders := []reco.Recommender{
+		evolver,
+		&reco.Popularity{},
+		&reco.TopConversion{},
+		&reco.CoView{},
+		&reco.CoPurchase{},
+		reco.DefaultBlend(),
+	}
+	if cfg.Fallback > 0 {
+		recommenders = append(recommenders, &reco.Fallback{Primary: evolver,
+			Secondary: reco.DefaultBlend(), Timeout: cfg.Fallback})
+	}
+
+	results = make([]*Metrics, 0)
+	for _, r := range recommenders {
+		results = append(results, newMetrics(r.String(), cfg.K))
+	}
+
+	snap, err := database.OpenSnapshot(ctx)
+	if err != nil {
+		return
+	}
+	defer snap.Close()
+
+	db := database.OpenDB()
+	defer db.Close()
+
+	catalogSize, err := database.QueryProductCount(ctx, db, cfg.AccountId)
+	if err != nil {
+		return
+	}
+	people, heldOut, err := holdOut(ctx, db, snap, cfg)
+	if err != nil {
+		return
+	}
+
+	for i, person := range people {
+		fmt.Printf("evaluating person %d of %d: %s\n", i+1, len(people), person.MonetateId)
+
+		var recommended [][]*database.Product
+		recommended, err = recommend(ctx, db, recommenders, cfg.AccountId, person, cfg.K)
+
+		// an interrupted evolver returns early with what it has, which isn't a fair comparison
+		if err == nil && ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		if err != nil {
+			fmt.Printf("stopped: %v, reporting on the first %d people\n", err, i)
+			break
+		}
+		for j, products := range recommended {
+			results[j].add(products, heldOut[person.MonetateId])
+		}
+	}
+
+	display(results, catalogSize)
+
+	return
+}
+
+// holdOut chooses the people to evaluate and the pids held out from each of them, keyed by
+// monetate id, and hides them in the snapshot. Co-occurrences, and conversion rates if they
+// were computed rather than loaded, are rebuilt afterwards so that they don't remember what
+// was hidden.
+func holdOut(ctx context.Context, db *sql.DB, snap *database.Snapshot,
+	cfg *Config) (people []*database.Person, heldOut map[string][]string, err error) {
+
+	heldOut = make(map[string][]string)
+
+	switch cfg.Split {
+	case VisitorSplit, "":
+		minPurchases := 2
+		if cfg.HoldOut >= 1.0 {
+			minPurchases = 1
+		}
+		people, err = database.QueryPeopleWithPurchases(ctx, db, cfg.AccountId, minPurchases,
+			time.Time{}, cfg.Sample)
+		if err != nil {
+			return
+		}
+		for _, person := range people {
+			var pids []string
+			pids, err = database.QueryPurchasedPids(ctx, db, cfg.AccountId, person, time.Time{})
+			if err != nil {
+				return
+			}
+			heldOut[person.MonetateId] = splitPurchases(pids, cfg.HoldOut)
+			err = snap.HideInteractions(ctx, cfg.AccountId, person, heldOut[person.MonetateId])
+			if err != nil {
+				return
+			}
+		}
+
+	case TimeSplit:
+		cutoff := cfg.Cutoff
+		if cutoff.IsZero() {
+			cutoff, err = database.QueryPurchaseCutoff(ctx, db, cfg.AccountId, cfg.HoldOut)
+			if err != nil {
+				return
+			}
+			if cutoff.IsZero() {
+				err = errors.New("none of the purchases are dated, so they can't be split by time")
+				return
+			}
+		}
+		fmt.Printf("holding out everything from %s on\n", cutoff.Format("2006-01-02"))
+		people, err = database.QueryPeopleWithPurchases(ctx, db, cfg.AccountId, 1, cutoff,
+			cfg.Sample)
+		if err != nil {
+			return
+		}
+		for _, person := range people {
+			heldOut[person.MonetateId], err = database.QueryPurchasedPids(ctx, db, cfg.AccountId,
+				person, cutoff)
+			if err != nil {
+				return
+			}
+		}
+		err = snap.HideInteractionsSince(ctx, cfg.AccountId, cutoff)
+		if err != nil {
+			return
+		}
+
+	default:
+		err = fmt.Errorf("unknown split %q, use %s or %s", cfg.Split, VisitorSplit, TimeSplit)
+		return
+	}
+
+	err = snap.RebuildCoOccurrences(ctx)
+	if err != nil {
+		return
+	}
+	err = snap.RebuildConversionRates(ctx, cfg.AccountId)
+	return
+}
+
+// recommend returns each recommender's products for the person, in the same order as the
+// recommenders, and stops at the first one that fails.
+func recommend(ctx context.Context, db *sql.DB, recommenders []reco.Recommender, accountId int64,
+	person *database.Person, k int) (recommended [][]*database.Product, err error) {
+
+	recommended = make([][]*database.Product, 0)
+	for _, r := range recommenders {
+		var products []*database.Product
+		products, err = r.Recommend(ctx, db, accountId, person, k)
+		if err != nil {
+			return
+		}
+		recommended = append(recommended, products)
+	}
+	return
+}
+
+func display(results []*Metrics, catalogSize int) {
+	width := len("recommender")
+	for _, m := range results {
+		if len(m.Name) > width {
+			width = len(m.Name)
+		}
+	}
+
+	fmt.Println("********** EVALUATION **********")
+	fmt.Printf("%-*s %8s %8s %8s %8s %8s\n", width, "recommender", "prec@k", "recall@k",
+		"hit rate", "ndcg", "coverage")
+	for _, m := range results {
+		fmt.Printf("%-*s %8.4f %8.4f %8.4f %8.4f %8.4f\n", width, m.Name, m.Precision(),
+			m.Recall(), m.HitRate(), m.NDCG(), m.Coverage(catalogSize))
+	}
+}
@@ -0,0 +1,88 @@
+package evaluate
+
+import (
+	"github.com/snyderep/recogen/database"
+	"math"
+)
+
+// Metrics accumulates ranking quality over every evaluated person for a single recommender.
+type Metrics struct {
+	Name        string
+	K           int
+	people      int
+	hits        int
+	precision   float64
+	recall      float64
+	ndcg        float64
+	recommended map[string]bool
+}
+
+func newMetrics(name string, k int) (m *Metrics) {
+	m = &Metrics{Name: name, K: k, recommended: make(map[string]bool)}
+	return
+}
+
+// add scores the top k of the ranked products against the person's held out pids.
+func (m *Metrics) add(products []*database.Product, heldOut []string) {
+	relevant := make(map[string]bool)
+	for _, pid := range heldOut {
+		relevant[pid] = true
+	}
+
+	if len(products) > m.K {
+		products = products[:m.K]
+	}
+
+	found := 0
+	dcg := 0.0
+	for i, p := range products {
+		m.recommended[p.Pid] = true
+		if relevant[p.Pid] {
+			found += 1
+			dcg += 1.0 / math.Log2(float64(i+2))
+		}
+	}
+
+	idcg := 0.0
+	for i := 0; i < len(relevant) && i < m.K; i++ {
+		idcg += 1.0 / math.Log2(float64(i+2))
+	}
+
+	m.people += 1
+	if found > 0 {
+		m.hits += 1
+	}
+	m.precision += float64(found) / float64(m.K)
+	if len(relevant) > 0 {
+		m.recall += float64(found) / float64(len(relevant))
+		m.ndcg += dcg / idcg
+	}
+}
+
+func (m *Metrics) average(total float64) float64 {
+	if m.people == 0 {
+		return 0.0
+	}
+	return total / float64(m.people)
+}
+
+func (m *Metrics) Precision() float64 {
+	return m.average(m.precision)
+}
+func (m *Metrics) Recall() float64 {
+	return m.average(m.recall)
+}
+func (m *Metrics) HitRate() float64 {
+	return m.average(float64(m.hits))
+}
+func (m *Metrics) NDCG() float64 {
+	return m.average(m.ndcg)
+}
+
+// Coverage is the fraction of the catalog that was recommended to at least one person.
+func (m *Metrics) Coverage(catalogSize int) float64 {
+	if catalogSize == 0 {
+		return 0.0
+	}
+	return float64(len(m.recommended)) / float64(catalogSize)
+}
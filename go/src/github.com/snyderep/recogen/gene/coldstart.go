@@ -0,0 +1,83 @@
+package gene
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/snyderep/recogen/database"
+)
+
+// number of popular and of high conversion products used to seed a visitor with no history
+const coldStartSize = 5
+
+// seedProducts returns the products the person viewed, purchased, added to the cart or
+// wishlisted, or the cold start products when the person has no history at all, along with
+// which of the two it was.
+func seedProducts(ctx context.Context, db *sql.DB, accountId int64,
+	person *database.Person) (products []*database.Product, provenance string, err error) {
+
+	products, err = database.QueryProductsViewedAndPurchased(ctx, db, accountId, person)
+	if err != nil {
+		return
+	}
+	seen := make(map[string]bool)
+	for _, p := range products {
+		seen[p.Pid] = true
+	}
+	for _, eventType := range []string{database.AddToCartEvent, database.WishlistEvent} {
+		var withEvent []*database.Product
+		withEvent, err = database.QueryProductsWithEvent(ctx, db, accountId, person, eventType)
+		if err != nil {
+			return
+		}
+		for _, p := range withEvent {
+			if !seen[p.Pid] {
+				seen[p.Pid] = true
+				products = append(products, p)
+			}
+		}
+	}
+	provenance = seedProvenance
+	if len(products) == 0 {
+		fmt.Printf("no history for %s, using cold start products\n", person.MonetateId)
+		products, err = coldStartProducts(ctx, db, accountId, person)
+		provenance = coldStartProvenance
+	}
+	return
+}
+
+// coldStartProducts returns the most popular and the highest converting products. If the
+// account has neither views nor conversion rates a random product is used, so the result is
+// only empty when the account has no products.
+func coldStartProducts(ctx context.Context, db *sql.DB, accountId int64,
+	person *database.Person) (products []*database.Product, err error) {
+
+	seen := make(map[string]bool)
+	products = make([]*database.Product, 0)
+
+	candidates, err := database.QueryMostViewedProducts(ctx, db, accountId, coldStartSize)
+	if err != nil {
+		return
+	}
+	topConversion, err := database.QueryTopConversionProducts(ctx, db, accountId, coldStartSize)
+	if err != nil {
+		return
+	}
+	candidates = append(candidates, topConversion...)
+	for _, p := range candidates {
+		if !seen[p.Pid] {
+			seen[p.Pid] = true
+			products = append(products, p)
+		}
+	}
+
+	if len(products) == 0 {
+		var product *database.Product
+		product, err = database.QueryRandomProduct(ctx, db, accountId, person)
+		if product != nil {
+			products = append(products, product)
+		}
+	}
+
+	return
+}
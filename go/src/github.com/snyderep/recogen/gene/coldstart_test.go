@@ -0,0 +1,106 @@
+package gene
+
+import (
+	"context"
+	"database/sql"
+	"github.com/snyderep/recogen/database"
+	"path/filepath"
+	"testing"
+)
+
+const testAccountId = 1
+
+// openTestDB points OpenDB at a new sqlite database with the schema and a few products, and
+// points it back when the test is done.
+func openTestDB(t *testing.T) (db *sql.DB) {
+	dsn := database.DSN
+	database.DSN = filepath.Join(t.TempDir(), "recogen.db")
+	t.Cleanup(func() { database.DSN = dsn })
+
+	db = database.OpenDB()
+	t.Cleanup(func() { db.Close() })
+	err := database.MigrateUp(context.Background(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	products := [][]interface{}{
+		{"1", "Silver Drop Earrings", 8.5},
+		{"2", "Koala Bear Necklace", 12.0},
+		{"3", "Justin Bieber Pillowcase", 15.0},
+		{"4", "Zebra Feather Drop Earrings", 7.0},
+	}
+	for _, p := range products {
+		testExec(t, db, "INSERT INTO product (account_id, pid, name, product_url, image_url, "+
+			"unit_cost, unit_price, margin, margin_rate) VALUES ($1, $2, $3, '', '', 0, $4, 0, 0)",
+			testAccountId, p[0], p[1], p[2])
+	}
+	return
+}
+
+func testExec(t *testing.T, db *sql.DB, query string, args ...interface{}) {
+	_, err := db.Exec(query, args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// runUnknownVisitor runs the evolver for a visitor with no history and checks that something
+// finite comes back.
+func runUnknownVisitor(t *testing.T) (ranked []*RankedProduct) {
+	cfg := &Config{AccountId: testAccountId, MonetateId: "unknown", MaxPopulation: 4,
+		MaxGenerations: 3}
+	ranked, err := Run(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ranked) == 0 {
+		t.Fatal("no recommendations for an unknown visitor")
+	}
+	for _, rp := range ranked {
+		if !isFinite(rp.Score) {
+			t.Errorf("%s scored %f", rp.Product.Pid, rp.Score)
+		}
+	}
+	return
+}
+
+func TestRunUnknownVisitor(t *testing.T) {
+	db := openTestDB(t)
+	testExec(t, db, "INSERT INTO user_product_views (account_id, monetate_id, pid, count) "+
+		"VALUES ($1, 'someone', '1', 3), ($1, 'someone', '2', 1), ($1, 'else', '2', 2)",
+		testAccountId)
+	testExec(t, db, "INSERT INTO product_conversion_rate (account_id, pid, conversion_rate) "+
+		"VALUES ($1, '3', 0.2), ($1, '4', 1.25)", testAccountId)
+
+	runUnknownVisitor(t)
+}
+
+func TestColdStartWithoutViewsOrConversionRates(t *testing.T) {
+	db := openTestDB(t)
+
+	products, err := coldStartProducts(context.Background(), db, testAccountId,
+		&database.Person{MonetateId: "unknown"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(products) != 1 {
+		t.Fatalf("got %d cold start products, want the one random product", len(products))
+	}
+
+	runUnknownVisitor(t)
+}
+
+func TestColdStartWithoutProducts(t *testing.T) {
+	db := openTestDB(t)
+	testExec(t, db, "DELETE FROM product")
+
+	products, err := coldStartProducts(context.Background(), db, testAccountId,
+		&database.Person{MonetateId: "unknown"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(products) != 0 {
+		t.Errorf("got %d cold start products from an empty catalog", len(products))
+	}
+}
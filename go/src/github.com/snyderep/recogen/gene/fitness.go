@@ -0,0 +1,264 @@
+package gene
+
+import (
+	"context"
+	"database/sql"
+	"github.com/snyderep/recogen/database"
+	"github.com/snyderep/recogen/similarity"
+	"math"
+)
+
+// score given to genomes that can't be scored, e.g. ones with no products. It is low enough
+// that such a genome is never selected over one with a real score.
+const invalidScore = -100.0
+
+// Weights sets how much each component counts towards a genome's fitness. Every component
+// scores between -10 and 15.
+type Weights struct {
+	Count      float64 `json:"count"`      // how close the number of products is to a useful list
+	Conversion float64 `json:"conversion"` // global conversion rate of the products
+	Seen       float64 `json:"seen"`       // products the person hasn't viewed, or viewed repeatedly
+	Purchased  float64 `json:"purchased"`  // penalty for products the person already purchased
+	Diversity  float64 `json:"diversity"`  // distinct categories and dissimilar names
+	Novelty    float64 `json:"novelty"`    // products that aren't already popular
+	Intent     float64 `json:"intent"`     // products the person added to the cart or wishlist but didn't buy
+}
+
+var DefaultWeights = Weights{Count: 0.4, Conversion: 0.2, Seen: 0.1, Purchased: 0.3,
+	Diversity: 0.2, Novelty: 0.1, Intent: 0.3}
+
+// productSignals holds what checkFitness looks up about a single product in a genome.
+type productSignals struct {
+	pid         string
+	name        string
+	categoryId  string
+	conversion  float64
+	totalViews  int64   // views by everyone
+	personViews float64 // views by the original person, after any decay
+	purchased   bool
+	carted      bool // added to the cart by the original person
+	wishlisted  bool // added to the wishlist by the original person
+}
+
+// checkFitness scores the genome. If any of the lookups fail the score is left as it was.
+func (g *Genome) checkFitness(ctx context.Context, db *sql.DB, cfg *Config,
+	originalPerson *database.Person) (err error) {
+
+	signals := make([]*productSignals, 0)
+
+	for _, prod := range g.rs.products {
+		var ps *productSignals
+		ps, err = lookupSignals(ctx, db, cfg, originalPerson, prod)
+		if err != nil {
+			return
+		}
+		signals = append(signals, ps)
+	}
+
+	var contributions []float64
+	g.score, contributions = scoreFitness(signals, cfg.getWeights())
+
+	for i, ps := range signals {
+		if prov, ok := g.rs.provenance[ps.pid]; ok {
+			prov.Fitness = contributions[i]
+		}
+	}
+	return
+}
+
+// lookupSignals queries what the fitness function needs to know about one of the products.
+func lookupSignals(ctx context.Context, db *sql.DB, cfg *Config, originalPerson *database.Person,
+	prod *database.Product) (ps *productSignals, err error) {
+
+	accountId := cfg.AccountId
+	ps = &productSignals{pid: prod.Pid, name: prod.Name, categoryId: prod.CategoryId}
+
+	ps.conversion, err = database.QueryGlobalConversion(ctx, db, accountId, prod)
+	if err != nil {
+		return
+	}
+	ps.totalViews, err = database.QueryProductViewCount(ctx, db, accountId, prod)
+	if err != nil {
+		return
+	}
+	ps.personViews, err = database.QueryPersonProductViewCount(ctx, db, accountId, originalPerson,
+		prod, cfg.decay)
+	if err != nil {
+		return
+	}
+	ps.purchased, err = database.HasProductBeenPurchasedByPerson(ctx, db, accountId,
+		originalPerson, prod)
+	if err != nil {
+		return
+	}
+	events, err := database.QueryPersonProductEventCounts(ctx, db, accountId, originalPerson, prod)
+	if err != nil {
+		return
+	}
+	ps.carted = events[database.AddToCartEvent] > 0
+	ps.wishlisted = events[database.WishlistEvent] > 0
+	return
+}
+
+// scoreFitness turns the signals for every product in a genome into a fitness score, along
+// with each product's share of it. The score is always finite, genomes that can't be scored
+// get invalidScore and no product is credited with anything.
+func scoreFitness(signals []*productSignals, weights *Weights) (fitness float64, contributions []float64) {
+	contributions = make([]float64, len(signals))
+
+	countScore := float64(0.0)
+	convScore := float64(0.0)
+	seenScore := float64(0.0)
+	purchScore := float64(0.0)
+	noveltyScore := float64(0.0)
+	intentScore := float64(0.0)
+
+	// adjust for the number of products
+	productCount := len(signals)
+	switch {
+	case productCount == 0:
+		// nothing to recommend, and nothing to average the other scores over
+		fitness = invalidScore
+		return
+	case productCount > 0 && productCount <= 5:
+		countScore = 5.0
+	case productCount > 5 && productCount <= 10:
+		countScore = 10.0
+	case productCount > 10 && productCount <= 20:
+		countScore = 15.0
+	case productCount > 20 && productCount <= 50:
+		countScore = 0.0
+	default:
+		countScore = -5.0
+	}
+
+	diversityScore := scoreDiversity(signals)
+
+	pCount := float64(productCount)
+
+	for i, ps := range signals {
+		var score float64
+		var contribution float64
+
+		score = float64(0.0)
+		conv := ps.conversion
+		switch {
+		case math.IsNaN(conv) || conv <= 0.0:
+			score = 0.0
+		case conv > 0.0 && conv <= 0.25:
+			score = 1.0
+		case conv > 0.25 && conv <= 0.5:
+			score = 3.0
+		case conv > 0.5 && conv <= 0.75:
+			score = 4.0
+		default:
+			score = 5.0
+		}
+		convScore += score
+		contribution += score * weights.Conversion
+
+		// something new scores best and a single glance scores nothing, but repeated views
+		// show an interest that is worth recommending back. Decayed views fall somewhere
+		// in between, an old glance is closer to new than a recent one.
+		score = float64(0.0)
+		switch {
+		case ps.personViews <= 0.0:
+			score = 5.0
+		case ps.personViews < 1.0:
+			score = 5.0 * (1.0 - ps.personViews)
+		default:
+			score = math.Min(5.0, 2.0*math.Log(ps.personViews))
+		}
+		seenScore += score
+		contribution += score * weights.Seen
+
+		score = float64(0.0)
+		if ps.purchased {
+			score = -10.0
+		} else {
+			score = 0.0
+		}
+		purchScore += score
+		contribution += score * weights.Purchased
+
+		// an abandoned cart is the strongest sign of interest short of a purchase
+		score = float64(0.0)
+		switch {
+		case ps.purchased:
+			score = 0.0
+		case ps.carted:
+			score = 5.0
+		case ps.wishlisted:
+			score = 3.0
+		}
+		intentScore += score
+		contribution += score * weights.Intent
+
+		// 5 for a product nobody has viewed, falling off with the log of the views
+		score = 5.0 / (1.0 + math.Log1p(math.Max(float64(ps.totalViews), 0.0)))
+		noveltyScore += score
+		contribution += score * weights.Novelty
+
+		// the count and diversity scores are shared equally
+		contributions[i] = (contribution + (countScore * weights.Count) +
+			(diversityScore * weights.Diversity)) / pCount
+	}
+
+	convScore = convScore / pCount
+	seenScore = seenScore / pCount
+	purchScore = purchScore / pCount
+	noveltyScore = noveltyScore / pCount
+	intentScore = intentScore / pCount
+
+	fitness = (countScore * weights.Count) + (convScore * weights.Conversion) +
+		(seenScore * weights.Seen) + (purchScore * weights.Purchased) +
+		(diversityScore * weights.Diversity) + (noveltyScore * weights.Novelty) +
+		(intentScore * weights.Intent)
+	// weights big enough to overflow a product's share can still leave the total finite
+	finite := isFinite(fitness)
+	for _, c := range contributions {
+		finite = finite && isFinite(c)
+	}
+	if !finite {
+		fitness = invalidScore
+		contributions = make([]float64, len(signals))
+	}
+
+	return
+}
+
+// scoreDiversity scores from 0, a single category and identical names, to 5, every product in
+// its own category with no name words in common. Products without a category share one.
+func scoreDiversity(signals []*productSignals) float64 {
+	if len(signals) < 2 {
+		// a single product is as diverse as it gets, but that isn't worth rewarding
+		return 0.0
+	}
+
+	categories := make(map[string]bool)
+	for _, ps := range signals {
+		categories[ps.categoryId] = true
+	}
+	categoryScore := float64(len(categories)-1) / float64(len(signals)-1)
+
+	words := make([]map[string]bool, 0)
+	for _, ps := range signals {
+		words = append(words, similarity.WordSet(ps.name))
+	}
+
+	dissimilarity := 0.0
+	pairs := 0
+	for i := 0; i < len(words); i++ {
+		for j := i + 1; j < len(words); j++ {
+			dissimilarity += 1.0 - similarity.Jaccard(words[i], words[j])
+			pairs += 1
+		}
+	}
+	nameScore := dissimilarity / float64(pairs)
+
+	return 5.0 * (categoryScore + nameScore) / 2.0
+}
+
+func isFinite(f float64) bool {
+	return !math.IsNaN(f) && !math.IsInf(f, 0)
+}
@@ -0,0 +1,124 @@
+package gene
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// values that have broken the scoring before, mixed in with ordinary random ones
+var awkwardFloats = []float64{math.NaN(), math.Inf(1), math.Inf(-1), -1.0, 0.0, 1e-300, 1e300,
+	math.MaxFloat64, -math.MaxFloat64}
+
+func randomFloat(r *rand.Rand) float64 {
+	if r.Intn(3) == 0 {
+		return awkwardFloats[r.Intn(len(awkwardFloats))]
+	}
+	return r.NormFloat64() * 10.0
+}
+
+func randomSignals(r *rand.Rand) (signals []*productSignals) {
+	names := []string{"", "Silver Drop Earrings", "silver drop earrings", "Koala Bear Necklace",
+		"!!!", "Justin Bieber Pillowcase"}
+	signals = make([]*productSignals, r.Intn(60))
+	for i := range signals {
+		signals[i] = &productSignals{pid: string(rune('a' + i)), name: names[r.Intn(len(names))],
+			categoryId: names[r.Intn(3)], conversion: randomFloat(r),
+			totalViews: r.Int63n(1000) - 10, personViews: randomFloat(r),
+			purchased: r.Intn(2) == 0, carted: r.Intn(2) == 0, wishlisted: r.Intn(2) == 0}
+	}
+	return
+}
+
+func randomWeights(r *rand.Rand) *Weights {
+	return &Weights{Count: randomFloat(r), Conversion: randomFloat(r), Seen: randomFloat(r),
+		Purchased: randomFloat(r), Diversity: randomFloat(r), Novelty: randomFloat(r),
+		Intent: randomFloat(r)}
+}
+
+func TestScoreFitnessIsAlwaysFinite(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 5000; i++ {
+		signals := randomSignals(r)
+		weights := &DefaultWeights
+		if i%2 == 1 {
+			weights = randomWeights(r)
+		}
+
+		fitness, contributions := scoreFitness(signals, weights)
+		if !isFinite(fitness) {
+			t.Fatalf("case %d: fitness %f for %d products, weights %+v", i, fitness,
+				len(signals), *weights)
+		}
+		if len(contributions) != len(signals) {
+			t.Fatalf("case %d: %d contributions for %d products", i, len(contributions),
+				len(signals))
+		}
+		for j, c := range contributions {
+			if !isFinite(c) {
+				t.Fatalf("case %d: product %d contributes %f, weights %+v", i, j, c, *weights)
+			}
+		}
+	}
+}
+
+func TestScoreFitnessOfNothing(t *testing.T) {
+	fitness, contributions := scoreFitness([]*productSignals{}, &DefaultWeights)
+	if fitness != invalidScore || len(contributions) != 0 {
+		t.Errorf("got %f and %d contributions, want %f and none", fitness, len(contributions),
+			invalidScore)
+	}
+}
+
+func TestScoreDiversityIsInRange(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	for i := 0; i < 1000; i++ {
+		signals := randomSignals(r)
+		d := scoreDiversity(signals)
+		if !isFinite(d) || d < 0.0 || d > 5.0 {
+			t.Fatalf("case %d: diversity %f for %d products", i, d, len(signals))
+		}
+	}
+}
+
+func TestMakeSelectionOnlyKeepsFiniteScores(t *testing.T) {
+	r := rand.New(rand.NewSource(3))
+	for i := 0; i < 1000; i++ {
+		pop := &Population{}
+		finite := 0
+		for j := 0; j < 1+r.Intn(30); j++ {
+			g := &Genome{rs: newRecoSet(), score: randomFloat(r)}
+			if isFinite(g.score) {
+				finite += 1
+			}
+			pop.genomes = append(pop.genomes, g)
+		}
+
+		err := pop.makeSelection()
+		if finite == 0 {
+			if err != errNoFiniteScore {
+				t.Fatalf("case %d: got %v with no finite scores, want %v", i, err,
+					errNoFiniteScore)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("case %d: %v", i, err)
+		}
+		if len(pop.genomes) == 0 {
+			t.Fatalf("case %d: nothing selected from %d finite scores", i, finite)
+		}
+		for _, g := range pop.genomes {
+			if !isFinite(g.score) {
+				t.Fatalf("case %d: selected a genome scoring %f", i, g.score)
+			}
+		}
+	}
+}
+
+func TestMakeSelectionOfNothing(t *testing.T) {
+	pop := &Population{}
+	if err := pop.makeSelection(); err != errNoFiniteScore {
+		t.Errorf("got %v, want %v", err, errNoFiniteScore)
+	}
+}
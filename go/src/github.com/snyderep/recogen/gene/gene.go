@@ -1,9 +1,14 @@
 package gene
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/snyderep/recogen/database"
+	"github.com/snyderep/recogen/rules"
+	"github.com/snyderep/recogen/similarity"
 	"math/rand"
 	"sort"
 	"time"
@@ -13,41 +18,65 @@ func init() {
 	rand.Seed(time.Now().UTC().UnixNano())
 }
 
+// ErrStopped is the cause to cancel Run's context with to stop the evolution early but still
+// get the best of what it found so far.
+var ErrStopped = errors.New("stopped")
+
 type Population struct {
 	genomes []*Genome
+	best    *Genome // a copy of the highest scoring genome from any finished generation
 }
 
-func (pop *Population) evolve(maxPopulation int, maxGenerations int, accountId int64,
-	originalPerson *database.Person) {
+// evolve runs the generations, stopping early at the first error from any of the genomes,
+// whether a query failed, timed out or the context was cancelled. The generation that failed
+// is thrown away, so best is left as of the generation before, and the error is returned.
+func (pop *Population) evolve(ctx context.Context, cfg *Config,
+	originalPerson *database.Person) (err error) {
 
 	db := database.OpenDB()
 	defer db.Close()
 
-	for g := 0; g < maxGenerations; g++ {
+	accountId := cfg.AccountId
+
+	for g := 0; g < cfg.MaxGenerations; g++ {
 		fmt.Printf("processing generation %d\n", g)
 
-		ch := make(chan bool)
+		ch := make(chan error)
 		for i := 0; i < len(pop.genomes); i++ {
-			go func(ch chan bool, genome *Genome) {
-				// apply the update of the last (current) trait a genome                
-				genome.getCurrentTrait().update(db, genome.rs, accountId, originalPerson)
-				genome.checkFitness(db, accountId, originalPerson)
-
-				ch <- true
+			go func(ch chan error, genome *Genome) {
+				// apply the update of the last (current) trait a genome
+				err := genome.getCurrentTrait().update(ctx, db, genome.rs, cfg, originalPerson)
+				if err == nil {
+					err = genome.applyRules(ctx, db, accountId, originalPerson, cfg.Rules)
+				}
+				if err == nil {
+					err = genome.checkFitness(ctx, db, cfg, originalPerson)
+				}
+				ch <- err
 			}(ch, pop.genomes[i])
 		}
-		// drain the channel
+		// drain the channel, keeping the first error
 		for i := 0; i < len(pop.genomes); i++ {
-			<-ch
+			if genomeErr := <-ch; genomeErr != nil && err == nil {
+				err = genomeErr
+			}
 		}
 
-		pop.display()
+		if err != nil {
+			fmt.Printf("generation %d stopped: %v, keeping the best genome so far\n", g, err)
+			return
+		}
 
-		if g == (maxGenerations - 1) {
-			pop.displayFinal()
-		} else {
-			// select genomes to carry forward to the next generation             
-			pop.makeSelection()
+		pop.display()
+		pop.keepBest()
+
+		if g < (cfg.MaxGenerations - 1) {
+			// select genomes to carry forward to the next generation
+			err = pop.makeSelection()
+			if err != nil {
+				fmt.Printf("generation %d stopped: %v, keeping the best genome so far\n", g, err)
+				return
+			}
 
 			// add new traits to the surviving genomes
 			for i := 0; i < len(pop.genomes); i++ {
@@ -56,7 +85,7 @@ func (pop *Population) evolve(maxPopulation int, maxGenerations int, accountId i
 
 			// have the successful ones reproduce to fill out the remainder of the population
 			childrenGenomes := make([]*Genome, 0)
-			for i := 0; i < (maxPopulation - len(pop.genomes)); i++ {
+			for i := 0; i < (cfg.MaxPopulation - len(pop.genomes)); i++ {
 				r1 := rand.Intn(len(pop.genomes))
 				r2 := rand.Intn(len(pop.genomes))
 				newGenome := reproduce(pop.genomes[r1], pop.genomes[r2])
@@ -65,21 +94,36 @@ func (pop *Population) evolve(maxPopulation int, maxGenerations int, accountId i
 			pop.appendGenomes(childrenGenomes)
 		}
 	}
+	return
 }
 
+// errNoFiniteScore stops the evolution when there's no genome left to select
+var errNoFiniteScore = errors.New("no genome has a finite score")
+
 // cheesy tournament selection - we consider everyone to be in the tournament.
 // Alternatively we could select a random number of genomes from the population
 // and select the fittest among those.
-func (pop *Population) makeSelection() {
+func (pop *Population) makeSelection() (err error) {
+	// a NaN would make the sort below meaningless, so anything that isn't finite never
+	// makes it into the tournament
 	scores := make([]float64, 0)
 	for i := 0; i < len(pop.genomes); i++ {
-		scores = append(scores, pop.genomes[i].score)
+		if isFinite(pop.genomes[i].score) {
+			scores = append(scores, pop.genomes[i].score)
+		}
+	}
+	if len(scores) == 0 {
+		err = errNoFiniteScore
+		return
 	}
 	sort.Float64s(scores)
 
-	// choose the top 50% of scores
+	// choose the top 50% of scores, but always at least one
 	topScores := make([]float64, 0)
 	topN := int(float64(len(scores)) * 0.5)
+	if topN < 1 {
+		topN = 1
+	}
 	for i := len(scores) - 1; i >= len(scores)-topN; i-- {
 		topScores = append(topScores, scores[i])
 	}
@@ -98,6 +142,7 @@ func (pop *Population) makeSelection() {
 	}
 
 	pop.genomes = selectedGenomes
+	return
 }
 func (pop *Population) display() {
 	for i := 0; i < len(pop.genomes); i++ {
@@ -109,21 +154,65 @@ func (pop *Population) display() {
 func (pop *Population) getHighestScoringGenome() (bestGenome *Genome) {
 	for i := 0; i < len(pop.genomes); i++ {
 		genome := pop.genomes[i]
+		if !isFinite(genome.score) {
+			continue
+		}
 		if bestGenome == nil || genome.score > bestGenome.score {
 			bestGenome = genome
 		}
 	}
 	return
 }
-func (pop *Population) displayFinal() {
+
+// keepBest copies the highest scoring genome if it beats the best so far. The genomes carry
+// on changing in later generations, so the copy is what's kept.
+func (pop *Population) keepBest() {
+	genome := pop.getHighestScoringGenome()
+	if genome != nil && (pop.best == nil || genome.score > pop.best.score) {
+		pop.best = genome.clone()
+	}
+}
+
+// bestScore returns the best genome's score, invalidScore if no generation finished.
+func (pop *Population) bestScore() float64 {
+	if pop.best == nil {
+		return invalidScore
+	}
+	return pop.best.score
+}
+func (pop *Population) displayFinal(ranked []*RankedProduct) {
 	fmt.Println("********** DONE **********")
 
-	bestGenome := pop.getHighestScoringGenome()
-	for _, product := range bestGenome.getProducts() {
-		fmt.Println(product.String())
+	for i, rp := range ranked {
+		fmt.Printf("rank: %d\nscore: %f\n", i+1, rp.Score)
+		fmt.Println(rp.Product.String())
+		fmt.Println(rp.Provenance.String())
 		fmt.Println("**************************")
 	}
-	fmt.Printf("Score: %f\n", bestGenome.score)
+	fmt.Printf("Score: %f\n", pop.bestScore())
+}
+func (pop *Population) save(ctx context.Context, run *database.RecommendationRun,
+	ranked []*RankedProduct) (err error) {
+
+	db := database.OpenDB()
+	defer db.Close()
+
+	run.Score = pop.bestScore()
+	run.FinishedAt = time.Now()
+
+	recos := make([]*database.Recommendation, 0)
+	for i, rp := range ranked {
+		r := &database.Recommendation{AccountId: run.AccountId, MonetateId: run.MonetateId,
+			Rank: i + 1, Score: rp.Score, GeneratedAt: run.FinishedAt, Product: rp.Product}
+		recos = append(recos, r)
+	}
+
+	err = database.SaveRecommendations(ctx, db, run, recos)
+	if err != nil {
+		return
+	}
+	fmt.Printf("saved %d recommendations as run %d\n", len(recos), run.RunId)
+	return
 }
 func (pop *Population) appendGenomes(genomes []*Genome) {
 	for i := 0; i < len(genomes); i++ {
@@ -132,8 +221,10 @@ func (pop *Population) appendGenomes(genomes []*Genome) {
 }
 
 type RecoSet struct {
-	products map[string]*database.Product
-	people   map[string]*database.Person
+	products   map[string]*database.Product
+	people     map[string]*database.Person
+	provenance map[string]*Provenance // keyed by pid
+	referrers  map[string]string      // pid each person was found through, keyed by monetate id
 }
 
 type Genome struct {
@@ -142,71 +233,53 @@ type Genome struct {
 	traits []Trait
 }
 
-func (g *Genome) checkFitness(db *sql.DB, accountId int64, originalPerson *database.Person) {
-	countScore := float64(0.0)
-	convScore := float64(0.0)
-	seenScore := float64(0.0)
-	purchScore := float64(0.0)
-
-	// adjust for the number of products 
-	productCount := g.getProductsCount()
-	switch {
-	case productCount == 0:
-		countScore = 0.0
-	case productCount > 0 && productCount <= 5:
-		countScore = 5.0
-	case productCount > 5 && productCount <= 10:
-		countScore = 10.0
-	case productCount > 10 && productCount <= 20:
-		countScore = 15.0
-	case productCount > 20 && productCount <= 50:
-		countScore = 0.0
-	default:
-		countScore = -5.0
-	}
-
-	for _, prod := range g.rs.products {
-		var score float64
-
-		score = float64(0.0)
-		conv := database.QueryGlobalConversion(db, accountId, prod)
-		switch {
-		case conv == 0.0:
-			score = 0.0
-		case conv > 0.0 && conv <= 0.25:
-			score = 1.0
-		case conv > 0.25 && conv <= 0.5:
-			score = 3.0
-		case conv > 0.5 && conv <= 0.75:
-			score = 4.0
-		default:
-			score = 5.0
-		}
-		convScore += score
+// applyRules removes the products that the account's rules don't allow.
+func (g *Genome) applyRules(ctx context.Context, db *sql.DB, accountId int64,
+	originalPerson *database.Person, accountRules *rules.Rules) (err error) {
 
-		score = float64(0.0)
-		if database.HasProductBeenSeenByPerson(db, accountId, originalPerson, prod) {
-			score = 0.0
-		} else {
-			score = 5.0
-		}
-		seenScore += score
+	if accountRules == nil {
+		return
+	}
 
-		score = float64(0.0)
-		if database.HasProductBeenPurchasedByPerson(db, accountId, originalPerson, prod) {
-			score = -10.0
-		} else {
-			score = 0.0
-		}
-		purchScore += score
+	// sort so that rules that depend on order, like the category limit, are repeatable
+	pids := make([]string, 0)
+	for pid, _ := range g.rs.products {
+		pids = append(pids, pid)
 	}
+	sort.Strings(pids)
 
-	pCount := float64(g.getProductsCount())
-	convScore = convScore / pCount
-	seenScore = seenScore / pCount
-	purchScore = purchScore / pCount
+	products := make([]*database.Product, 0)
+	for _, pid := range pids {
+		products = append(products, g.rs.products[pid])
+	}
 
-	g.score = (countScore * 0.4) + (convScore * 0.2) + (seenScore * 0.1) + (purchScore * 0.3)
+	kept, err := accountRules.Filter(ctx, db, accountId, originalPerson, products)
+	if err != nil {
+		return
+	}
+	allowed := make(map[string]bool)
+	for _, p := range kept {
+		allowed[p.Pid] = true
+	}
+	for _, pid := range pids {
+		if !allowed[pid] {
+			g.rs.deleteProduct(pid)
+		}
+	}
+	return
+}
+
+// clone copies the genome, with its own copy of the products, people and provenance.
+func (g *Genome) clone() (c *Genome) {
+	rs := newRecoSet()
+	for pid, _ := range g.rs.products {
+		rs.copyProduct(g.rs, pid)
+	}
+	for monetateId, _ := range g.rs.people {
+		rs.copyPerson(g.rs, monetateId)
+	}
+	c = &Genome{rs: rs, score: g.score, traits: append([]Trait{}, g.traits...)}
+	return
 }
 func (g *Genome) getCurrentTrait() (trait Trait) {
 	if len(g.traits) == 0 {
@@ -243,14 +316,155 @@ func (g *Genome) getProducts() (products map[string]*database.Product) {
 	return g.rs.products
 }
 
-func Run(maxPopulation int, maxGenerations int, accountId int64, monetateId string) {
-	originalPerson := &database.Person{monetateId}
+// Config holds the parameters for a single run of the evolver.
+type Config struct {
+	AccountId      int64
+	MonetateId     string
+	MaxPopulation  int
+	MaxGenerations int
+	Scorer         Scorer       // orders the final products, conversion rate if nil
+	TopK           int          // number of products to keep, 0 keeps them all
+	Save           bool         // write the ranked products to the recommendation tables
+	Rules          *rules.Rules // the account's business rules, nil for none
+	Weights        *Weights     // fitness weights, DefaultWeights if nil
+	HalfLife       float64      // days for an interaction's weight to halve, 0 for no decay
+
+	decay *database.Decay
+	names *similarity.Index // the account's product names, for the similar name trait
+}
+
+func (cfg *Config) getWeights() *Weights {
+	if cfg.Weights == nil {
+		return &DefaultWeights
+	}
+	return cfg.Weights
+}
+
+// Run evolves recommendations for the person and returns the best genome's products
+// ranked by the configured scorer. A failed query, one that timed out or the context being
+// cancelled with ErrStopped as its cause stops the evolution, and the best genome found up to
+// then is ranked and returned. Any other end to the context, like its deadline passing, stops
+// the run without ranking anything and its error is returned.
+func Run(ctx context.Context, cfg *Config) (ranked []*RankedProduct, err error) {
+	originalPerson := &database.Person{MonetateId: cfg.MonetateId}
+
+	startedAt := time.Now()
+
+	db := database.OpenDB()
+	defer db.Close()
+
+	// decay relative to the newest interaction, not today, so that old extracts still work
+	if cfg.HalfLife > 0.0 {
+		var reference time.Time
+		reference, err = database.QueryLatestInteraction(ctx, db, cfg.AccountId)
+		if err != nil {
+			return
+		}
+		cfg.decay = &database.Decay{HalfLife: cfg.HalfLife, Reference: reference}
+	}
+
+	// built for every run, so that it's never out of date with the loaded products
+	catalog, err := database.QueryAllProducts(ctx, db, cfg.AccountId)
+	if err != nil {
+		return
+	}
+	cfg.names = similarity.NewIndex(catalog)
+
+	pop, err := makeRandomPopulation(ctx, cfg.MaxPopulation, cfg.AccountId, originalPerson)
+	if err != nil {
+		return
+	}
+	// the evolution reports why it stopped early, if it did, and what it found is still used
+	pop.evolve(ctx, cfg, originalPerson)
+
+	if ctx.Err() != nil {
+		if context.Cause(ctx) != ErrStopped {
+			err = context.Cause(ctx)
+			return
+		}
+		// what was found is ranked and saved even though the evolution was stopped
+		ctx = context.WithoutCancel(ctx)
+	}
 
-	pop := makeRandomPopulation(maxPopulation, accountId, originalPerson)
-	pop.evolve(maxPopulation, maxGenerations, accountId, originalPerson)
+	rs := newRecoSet()
+	if pop.best != nil {
+		rs = pop.best.rs
+	}
+	if len(rs.products) == 0 {
+		// everything was deleted along the way, or not even one generation finished, don't
+		// come back empty handed
+		var products []*database.Product
+		products, err = coldStartProducts(ctx, db, cfg.AccountId, originalPerson)
+		if err != nil {
+			return
+		}
+		for _, p := range products {
+			rs.addProduct(p, &Provenance{Trait: coldStartProvenance})
+		}
+	}
+
+	scorer := cfg.Scorer
+	if scorer == nil {
+		scorer = &ConversionScorer{}
+	}
+	ranked, err = rankProducts(ctx, db, cfg.AccountId, originalPerson, rs, scorer)
+	if err != nil {
+		return
+	}
+	ranked, err = filterRanked(ctx, db, cfg.AccountId, originalPerson, ranked, cfg.Rules)
+	if err != nil {
+		return
+	}
+	if cfg.TopK > 0 && len(ranked) > cfg.TopK {
+		ranked = ranked[:cfg.TopK]
+	}
+
+	// the deadline could have passed while ranking, in which case nobody wants the results
+	err = ctx.Err()
+	if err != nil {
+		return
+	}
+
+	pop.displayFinal(ranked)
+
+	if cfg.Save {
+		var run *database.RecommendationRun
+		run, err = newRecommendationRun(cfg, scorer, startedAt)
+		if err != nil {
+			return
+		}
+		err = pop.save(ctx, run, ranked)
+	}
+
+	return
 }
 
-func makeRandomPopulation(size int, accountId int64, originalPerson *database.Person) (pop *Population) {
+// newRecommendationRun records the settings the run is being made with.
+func newRecommendationRun(cfg *Config, scorer Scorer,
+	startedAt time.Time) (run *database.RecommendationRun, err error) {
+
+	weights, err := json.Marshal(cfg.getWeights())
+	if err != nil {
+		return
+	}
+	var accountRules []byte
+	if cfg.Rules != nil {
+		accountRules, err = json.Marshal(cfg.Rules)
+		if err != nil {
+			return
+		}
+	}
+
+	run = &database.RecommendationRun{AccountId: cfg.AccountId, MonetateId: cfg.MonetateId,
+		MaxPopulation: cfg.MaxPopulation, MaxGenerations: cfg.MaxGenerations,
+		StartedAt: startedAt, Scorer: scorer.String(), TopK: cfg.TopK,
+		Weights: string(weights), HalfLife: cfg.HalfLife, Rules: string(accountRules)}
+	return
+}
+
+func makeRandomPopulation(ctx context.Context, size int, accountId int64,
+	originalPerson *database.Person) (pop *Population, err error) {
+
 	db := database.OpenDB()
 	defer db.Close()
 
@@ -258,20 +472,23 @@ func makeRandomPopulation(size int, accountId int64, originalPerson *database.Pe
 
 	genomes := make([]*Genome, size)
 
+	// the original person's products, or popular ones if the person is unknown
+	products, provenance, err := seedProducts(ctx, db, accountId, originalPerson)
+	if err != nil {
+		return
+	}
+
 	for i := 0; i < size; i++ {
+		rs := newRecoSet()
+
 		// seed with the original person
-		persMap := make(map[string]*database.Person)
-		persMap[originalPerson.MonetateId] = originalPerson
+		rs.addPerson(originalPerson, "")
 
 		// seed with the original person's products
-		prodMap := make(map[string]*database.Product)
-		// TODO: Don't requery for every genome
-		products := database.QueryProductsViewedAndPurchased(db, accountId, originalPerson)
 		for i := 0; i < len(products); i++ {
-			prodMap[products[i].Pid] = products[i]
+			rs.addProduct(products[i], &Provenance{Trait: provenance, Person: originalPerson.MonetateId})
 		}
 
-		rs := &RecoSet{products: prodMap, people: persMap}
 		genome := &Genome{rs: rs, score: 0.0}
 		genome.addRandomTrait()
 		genomes[i] = genome
@@ -284,39 +501,38 @@ func makeRandomPopulation(size int, accountId int64, originalPerson *database.Pe
 
 func reproduce(oneGenome *Genome, anotherGenome *Genome) (childGenome *Genome) {
 	childGenome = &Genome{score: 0.0}
-	childProducts := make(map[string]*database.Product)
-	childPeople := make(map[string]*database.Person)
+	childRs := newRecoSet()
 	childGenome.traits = make([]Trait, 0)
 
 	for _, p := range oneGenome.getProducts() {
 		coin := rand.Int31n(2)
 		if coin == 1 {
-			childProducts[p.Pid] = p
+			childRs.copyProduct(oneGenome.rs, p.Pid)
 		}
 	}
 	for _, p := range anotherGenome.getProducts() {
 		coin := rand.Int31n(2)
 		if coin == 1 {
-			childProducts[p.Pid] = p
+			childRs.copyProduct(anotherGenome.rs, p.Pid)
 		}
 	}
 
 	for _, p := range oneGenome.getPeople() {
 		coin := rand.Int31n(2)
 		if coin == 1 {
-			childPeople[p.MonetateId] = p
+			childRs.copyPerson(oneGenome.rs, p.MonetateId)
 		}
 	}
 	for _, p := range anotherGenome.getPeople() {
 		coin := rand.Int31n(2)
 		if coin == 1 {
-			childPeople[p.MonetateId] = p
+			childRs.copyPerson(anotherGenome.rs, p.MonetateId)
 		}
 	}
 
 	childGenome.traits = append(childGenome.traits, &NopTrait{})
 
-	childGenome.rs = &RecoSet{products: childProducts, people: childPeople}
+	childGenome.rs = childRs
 
 	return
 }
@@ -0,0 +1,79 @@
+package gene
+
+import (
+	"fmt"
+	"github.com/snyderep/recogen/database"
+)
+
+// Provenance explains how a product came to be in a RecoSet.
+type Provenance struct {
+	Trait   string  `json:"trait"`             // the trait that added the product, or seed / cold start
+	Person  string  `json:"person,omitempty"`  // monetate id of the person it came through
+	Product string  `json:"product,omitempty"` // pid of the product it was derived from
+	Fitness float64 `json:"fitness"`           // the product's share of the genome's fitness
+}
+
+func (p *Provenance) String() string {
+	if p == nil {
+		return "added by: unknown"
+	}
+	s := "added by: " + p.Trait
+	if p.Person != "" {
+		s += "\nthrough person: " + p.Person
+	}
+	if p.Product != "" {
+		s += "\nfrom product: " + p.Product
+	}
+	return s + fmt.Sprintf("\nfitness contribution: %f", p.Fitness)
+}
+
+const (
+	seedProvenance      = "seed"
+	coldStartProvenance = "cold start"
+)
+
+func newRecoSet() (rs *RecoSet) {
+	rs = &RecoSet{products: make(map[string]*database.Product),
+		people:     make(map[string]*database.Person),
+		provenance: make(map[string]*Provenance),
+		referrers:  make(map[string]string)}
+	return
+}
+
+// addProduct adds the product unless it is already present, in which case the original
+// explanation is kept.
+func (rs *RecoSet) addProduct(product *database.Product, prov *Provenance) {
+	if _, ok := rs.products[product.Pid]; ok {
+		return
+	}
+	rs.products[product.Pid] = product
+	rs.provenance[product.Pid] = prov
+}
+func (rs *RecoSet) deleteProduct(pid string) {
+	delete(rs.products, pid)
+	delete(rs.provenance, pid)
+}
+
+// addPerson adds the person along with the pid of the product they were found through, which
+// is empty for the original person.
+func (rs *RecoSet) addPerson(person *database.Person, pid string) {
+	rs.people[person.MonetateId] = person
+	if pid != "" {
+		rs.referrers[person.MonetateId] = pid
+	}
+}
+
+// copyProduct copies the product and a private copy of its provenance from another set.
+func (rs *RecoSet) copyProduct(from *RecoSet, pid string) {
+	rs.products[pid] = from.products[pid]
+	if prov, ok := from.provenance[pid]; ok {
+		p := *prov
+		rs.provenance[pid] = &p
+	}
+}
+func (rs *RecoSet) copyPerson(from *RecoSet, monetateId string) {
+	rs.people[monetateId] = from.people[monetateId]
+	if pid, ok := from.referrers[monetateId]; ok {
+		rs.referrers[monetateId] = pid
+	}
+}
@@ -0,0 +1,149 @@
+package gene
+
+import (
+	"context"
+	"database/sql"
+	"github.com/snyderep/recogen/database"
+	"github.com/snyderep/recogen/rules"
+	"sort"
+)
+
+// A Scorer orders the products of the winning genome, higher scores rank first.
+type Scorer interface {
+	String() string
+	score(context.Context, *sql.DB, int64, *database.Person, *database.Product) (float64, error)
+}
+
+var allScorers []Scorer
+
+func init() {
+	allScorers = append(allScorers, &ConversionScorer{})
+	allScorers = append(allScorers, &PriceScorer{})
+	allScorers = append(allScorers, &CoOccurrenceScorer{})
+	allScorers = append(allScorers, &MarginScorer{})
+}
+
+// GetScorer returns the scorer with the given name, or nil if there isn't one.
+func GetScorer(name string) Scorer {
+	for _, s := range allScorers {
+		if s.String() == name {
+			return s
+		}
+	}
+	return nil
+}
+
+type ConversionScorer struct{}
+
+func (s *ConversionScorer) String() string {
+	return "conversion"
+}
+func (s *ConversionScorer) score(ctx context.Context, db *sql.DB, accountId int64,
+	origPerson *database.Person, product *database.Product) (float64, error) {
+
+	return database.QueryGlobalConversion(ctx, db, accountId, product)
+}
+
+type PriceScorer struct{}
+
+func (s *PriceScorer) String() string {
+	return "price"
+}
+func (s *PriceScorer) score(ctx context.Context, db *sql.DB, accountId int64,
+	origPerson *database.Person, product *database.Product) (float64, error) {
+
+	return product.UnitPrice, nil
+}
+
+type CoOccurrenceScorer struct{}
+
+func (s *CoOccurrenceScorer) String() string {
+	return "co-occurrence"
+}
+func (s *CoOccurrenceScorer) score(ctx context.Context, db *sql.DB, accountId int64,
+	origPerson *database.Person, product *database.Product) (float64, error) {
+
+	count, err := database.QueryCoOccurrenceCount(ctx, db, accountId, origPerson, product)
+	return float64(count), err
+}
+
+type MarginScorer struct{}
+
+func (s *MarginScorer) String() string {
+	return "margin"
+}
+func (s *MarginScorer) score(ctx context.Context, db *sql.DB, accountId int64,
+	origPerson *database.Person, product *database.Product) (float64, error) {
+
+	return product.Margin, nil
+}
+
+type RankedProduct struct {
+	Product    *database.Product `json:"product"`
+	Score      float64           `json:"score"`
+	Provenance *Provenance       `json:"provenance"`
+}
+
+type byScore []*RankedProduct
+
+func (b byScore) Len() int {
+	return len(b)
+}
+func (b byScore) Swap(i, j int) {
+	b[i], b[j] = b[j], b[i]
+}
+func (b byScore) Less(i, j int) bool {
+	// ties fall back to the pid so the ranking is stable
+	if b[i].Score == b[j].Score {
+		return b[i].Product.Pid < b[j].Product.Pid
+	}
+	return b[i].Score > b[j].Score
+}
+
+// rankProducts scores every product and orders them best first.
+func rankProducts(ctx context.Context, db *sql.DB, accountId int64, origPerson *database.Person,
+	rs *RecoSet, scorer Scorer) (ranked []*RankedProduct, err error) {
+
+	ranked = make([]*RankedProduct, 0)
+	for pid, p := range rs.products {
+		var s float64
+		s, err = scorer.score(ctx, db, accountId, origPerson, p)
+		if err != nil {
+			return
+		}
+		if !isFinite(s) {
+			s = 0.0
+		}
+		ranked = append(ranked, &RankedProduct{Product: p, Score: s, Provenance: rs.provenance[pid]})
+	}
+	sort.Sort(byScore(ranked))
+	return
+}
+
+// filterRanked drops the ranked products that the account's rules don't allow. The rules see
+// the products in rank order, so limits keep the best ranked products.
+func filterRanked(ctx context.Context, db *sql.DB, accountId int64, origPerson *database.Person,
+	ranked []*RankedProduct, accountRules *rules.Rules) (filtered []*RankedProduct, err error) {
+
+	products := make([]*database.Product, 0)
+	for _, rp := range ranked {
+		products = append(products, rp.Product)
+	}
+
+	kept, err := accountRules.Filter(ctx, db, accountId, origPerson, products)
+	if err != nil {
+		return
+	}
+	allowed := make(map[string]bool)
+	for _, p := range kept {
+		allowed[p.Pid] = true
+	}
+
+	filtered = make([]*RankedProduct, 0)
+	for _, rp := range ranked {
+		if allowed[rp.Product.Pid] {
+			filtered = append(filtered, rp)
+		}
+	}
+	return
+}
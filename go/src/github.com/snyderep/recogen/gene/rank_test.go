@@ -0,0 +1,78 @@
+package gene
+
+import (
+	"context"
+	"github.com/snyderep/recogen/database"
+	"github.com/snyderep/recogen/rules"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestGetScorer(t *testing.T) {
+	for _, name := range []string{"conversion", "price", "co-occurrence", "margin"} {
+		if s := GetScorer(name); s == nil || s.String() != name {
+			t.Errorf("no scorer named %s", name)
+		}
+	}
+	if GetScorer("popularity") != nil {
+		t.Error("found a scorer that doesn't exist")
+	}
+}
+
+func rankedPids(ranked []*RankedProduct) (pids []string) {
+	pids = make([]string, 0)
+	for _, rp := range ranked {
+		pids = append(pids, rp.Product.Pid)
+	}
+	return
+}
+
+func TestRankProducts(t *testing.T) {
+	rs := newRecoSet()
+	for _, p := range []*database.Product{
+		{Pid: "a", UnitPrice: 10, Margin: 2, CategoryId: "x"},
+		{Pid: "b", UnitPrice: 30, Margin: math.NaN(), CategoryId: "x"},
+		{Pid: "c", UnitPrice: 20, Margin: 2},
+		{Pid: "d", UnitPrice: 10, Margin: math.Inf(1), CategoryId: "x"},
+	} {
+		rs.addProduct(p, &Provenance{Trait: "trait " + p.Pid})
+	}
+
+	tests := []struct {
+		scorer Scorer
+		rules  *rules.Rules
+		want   []string
+	}{
+		// a and d tie on price and are ordered by pid
+		{&PriceScorer{}, nil, []string{"b", "c", "a", "d"}},
+		// the margins that aren't finite score 0
+		{&MarginScorer{}, nil, []string{"a", "c", "b", "d"}},
+		// the rules see the products best first, so b is the one of x kept
+		{&PriceScorer{}, &rules.Rules{MaxPerCategory: 1}, []string{"b", "c"}},
+		{&MarginScorer{}, &rules.Rules{MaxPrice: 15}, []string{"a", "d"}},
+	}
+
+	ctx := context.Background()
+	for _, test := range tests {
+		ranked, err := rankProducts(ctx, nil, 321, &database.Person{}, rs, test.scorer)
+		if err == nil {
+			ranked, err = filterRanked(ctx, nil, 321, &database.Person{}, ranked, test.rules)
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.scorer, err)
+			continue
+		}
+		if got := rankedPids(ranked); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s with %+v: got %v, want %v", test.scorer, test.rules, got, test.want)
+		}
+		for _, rp := range ranked {
+			if !isFinite(rp.Score) {
+				t.Errorf("%s: %s scored %f", test.scorer, rp.Product.Pid, rp.Score)
+			}
+			if rp.Provenance == nil || rp.Provenance.Trait != "trait "+rp.Product.Pid {
+				t.Errorf("%s: %s lost its provenance", test.scorer, rp.Product.Pid)
+			}
+		}
+	}
+}
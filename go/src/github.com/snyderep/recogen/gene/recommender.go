@@ -0,0 +1,40 @@
+package gene
+
+import (
+	"context"
+	"database/sql"
+	"github.com/snyderep/recogen/database"
+)
+
+// Evolver recommends the products of the best genome found by evolving a population. The
+// Config's account, person and top k are set from what's asked for, everything else in it is
+// used as it is.
+type Evolver struct {
+	Config
+
+	Ranked []*RankedProduct // what the last Recommend returned, with explanations, nil if it failed
+}
+
+func (e *Evolver) String() string {
+	return "genetic"
+}
+func (e *Evolver) Recommend(ctx context.Context, db *sql.DB, accountId int64,
+	person *database.Person, k int) (products []*database.Product, err error) {
+
+	cfg := e.Config
+	cfg.AccountId = accountId
+	cfg.MonetateId = person.MonetateId
+	cfg.TopK = k
+
+	e.Ranked = nil
+	ranked, err := Run(ctx, &cfg)
+	if err != nil {
+		return
+	}
+	e.Ranked = ranked
+	products = make([]*database.Product, 0)
+	for _, rp := range ranked {
+		products = append(products, rp.Product)
+	}
+	return
+}
@@ -1,6 +1,7 @@
 package gene
 
 import (
+	"context"
 	"database/sql"
 	"github.com/snyderep/recogen/database"
 	"math/rand"
@@ -8,7 +9,7 @@ import (
 
 type Trait interface {
 	String() string
-	update(*sql.DB, *RecoSet, int64, *database.Person)
+	update(context.Context, *sql.DB, *RecoSet, *Config, *database.Person) error
 }
 
 var allTraits []Trait
@@ -20,6 +21,25 @@ func init() {
 	allTraits = append(allTraits, &RandomProductTrait{})
 	allTraits = append(allTraits, &RandomProductDeleteTrait{})
 	allTraits = append(allTraits, &SoundAlikeProductTrait{})
+	allTraits = append(allTraits, &SameCategoryProductTrait{})
+	allTraits = append(allTraits, &ComplementaryCategoryProductTrait{})
+	allTraits = append(allTraits, &SimilarNameProductTrait{})
+	allTraits = append(allTraits, &CoOccurringProductTrait{})
+	allTraits = append(allTraits, &RecentlyViewedExpansionTrait{})
+	allTraits = append(allTraits, &NextViewedProductTrait{})
+}
+
+// randomProduct picks one of the products uniformly at random, nil if there are none. Go's
+// map iteration order isn't specified to be random, let alone uniform, so it's no use for this.
+func randomProduct(products map[string]*database.Product) *database.Product {
+	if len(products) == 0 {
+		return nil
+	}
+	pids := make([]string, 0, len(products))
+	for pid, _ := range products {
+		pids = append(pids, pid)
+	}
+	return products[pids[rand.Intn(len(pids))]]
 }
 
 type NopTrait struct{}
@@ -27,8 +47,11 @@ type NopTrait struct{}
 func (t *NopTrait) String() string {
 	return "nop"
 }
-func (t *NopTrait) update(db *sql.DB, rs *RecoSet, accountId int64, origPerson *database.Person) {
+func (t *NopTrait) update(ctx context.Context, db *sql.DB, rs *RecoSet, cfg *Config,
+	origPerson *database.Person) (err error) {
+
 	// do nothing, this is a nop after all
+	return
 }
 
 type PeopleThatViewedProductsTrait struct{}
@@ -36,26 +59,48 @@ type PeopleThatViewedProductsTrait struct{}
 func (t *PeopleThatViewedProductsTrait) String() string {
 	return "people that viewed products"
 }
-func (t *PeopleThatViewedProductsTrait) update(db *sql.DB, rs *RecoSet, accountId int64, origPerson *database.Person) {
-	people := database.QueryPeopleThatViewedProducts(db, accountId, rs.products)
-	peeps := make(map[string]*database.Person)
-	for i := 0; i < len(people); i++ {
-		//rs.people[people[i].MonetateId] = people[i]
-		peeps[people[i].MonetateId] = people[i]
+func (t *PeopleThatViewedProductsTrait) update(ctx context.Context, db *sql.DB, rs *RecoSet,
+	cfg *Config, origPerson *database.Person) (err error) {
+
+	rs.people = make(map[string]*database.Person)
+	rs.referrers = make(map[string]string)
+	for pid, product := range rs.products {
+		products := map[string]*database.Product{pid: product}
+		people, err := database.QueryPeopleThatViewedProducts(ctx, db, cfg.AccountId, products,
+			cfg.decay)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < len(people); i++ {
+			rs.addPerson(people[i], pid)
+		}
 	}
-	rs.people = peeps
+	return
 }
 
+// most products taken from any one person, favouring the ones they viewed most
+const viewedProductsPerPerson = 5
+
 type ProductsViewedByPeopleTrait struct{}
 
 func (t *ProductsViewedByPeopleTrait) String() string {
 	return "products viewed by people"
 }
-func (t *ProductsViewedByPeopleTrait) update(db *sql.DB, rs *RecoSet, accountId int64, origPerson *database.Person) {
-	products := database.QueryProductsViewedByPeople(db, accountId, rs.people)
-	for i := 0; i < len(products); i++ {
-		rs.products[products[i].Pid] = products[i]
+func (t *ProductsViewedByPeopleTrait) update(ctx context.Context, db *sql.DB, rs *RecoSet,
+	cfg *Config, origPerson *database.Person) (err error) {
+
+	for _, person := range rs.people {
+		products, err := database.QuerySampledProductsViewed(ctx, db, cfg.AccountId, person,
+			viewedProductsPerPerson, cfg.decay)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < len(products); i++ {
+			rs.addProduct(products[i], &Provenance{Trait: t.String(), Person: person.MonetateId,
+				Product: rs.referrers[person.MonetateId]})
+		}
 	}
+	return
 }
 
 type RandomProductTrait struct{}
@@ -63,11 +108,14 @@ type RandomProductTrait struct{}
 func (t *RandomProductTrait) String() string {
 	return "random product"
 }
-func (t *RandomProductTrait) update(db *sql.DB, rs *RecoSet, accountId int64, origPerson *database.Person) {
-	product := database.QueryRandomProduct(db, accountId, origPerson)
+func (t *RandomProductTrait) update(ctx context.Context, db *sql.DB, rs *RecoSet, cfg *Config,
+	origPerson *database.Person) (err error) {
+
+	product, err := database.QueryRandomProduct(ctx, db, cfg.AccountId, origPerson)
 	if product != nil {
-		rs.products[product.Pid] = product
+		rs.addProduct(product, &Provenance{Trait: t.String()})
 	}
+	return
 }
 
 type RandomProductDeleteTrait struct{}
@@ -75,13 +123,16 @@ type RandomProductDeleteTrait struct{}
 func (t *RandomProductDeleteTrait) String() string {
 	return "random product delete"
 }
-func (t *RandomProductDeleteTrait) update(db *sql.DB, rs *RecoSet, accountId int64, origPerson *database.Person) {
+func (t *RandomProductDeleteTrait) update(ctx context.Context, db *sql.DB, rs *RecoSet,
+	cfg *Config, origPerson *database.Person) (err error) {
+
 	for pid, _ := range rs.products {
 		coin := rand.Intn(10)
 		if coin == 0 {
-			delete(rs.products, pid)
+			rs.deleteProduct(pid)
 		}
 	}
+	return
 }
 
 type SoundAlikeProductTrait struct{}
@@ -89,17 +140,218 @@ type SoundAlikeProductTrait struct{}
 func (t *SoundAlikeProductTrait) String() string {
 	return "sound alike product"
 }
-func (t *SoundAlikeProductTrait) update(db *sql.DB, rs *RecoSet, accountId int64, origPerson *database.Person) {
-	if len(rs.products) > 0 {
-		// take advantage of the fact that go randomizes the iteration order of map items
-		var inProduct *database.Product
-		for _, p := range rs.products {
-			inProduct = p
+func (t *SoundAlikeProductTrait) update(ctx context.Context, db *sql.DB, rs *RecoSet, cfg *Config,
+	origPerson *database.Person) (err error) {
+
+	inProduct := randomProduct(rs.products)
+	if inProduct == nil {
+		return
+	}
+	outProduct, err := database.QuerySoundAlikeProduct(ctx, db, cfg.AccountId, inProduct)
+	if outProduct != nil {
+		rs.addProduct(outProduct, &Provenance{Trait: t.String(), Product: inProduct.Pid})
+	}
+	return
+}
+
+type SameCategoryProductTrait struct{}
+
+func (t *SameCategoryProductTrait) String() string {
+	return "same category product"
+}
+func (t *SameCategoryProductTrait) update(ctx context.Context, db *sql.DB, rs *RecoSet,
+	cfg *Config, origPerson *database.Person) (err error) {
+
+	categorised := make(map[string]*database.Product)
+	for pid, p := range rs.products {
+		if p.CategoryId != "" {
+			categorised[pid] = p
+		}
+	}
+	inProduct := randomProduct(categorised)
+	if inProduct == nil {
+		return
+	}
+	outProduct, err := database.QueryRandomProductInCategory(ctx, db, cfg.AccountId,
+		inProduct.CategoryId, inProduct.Pid)
+	if outProduct != nil {
+		rs.addProduct(outProduct, &Provenance{Trait: t.String(), Product: inProduct.Pid})
+	}
+	return
+}
+
+// number of complementary categories to choose from
+const complementaryCategories = 3
+
+type ComplementaryCategoryProductTrait struct{}
+
+func (t *ComplementaryCategoryProductTrait) String() string {
+	return "complementary category product"
+}
+func (t *ComplementaryCategoryProductTrait) update(ctx context.Context, db *sql.DB, rs *RecoSet,
+	cfg *Config, origPerson *database.Person) (err error) {
+
+	categoryIds, err := database.QueryComplementaryCategories(ctx, db, cfg.AccountId, origPerson,
+		complementaryCategories)
+	if err != nil {
+		return
+	}
+	if len(categoryIds) > 0 {
+		categoryId := categoryIds[rand.Intn(len(categoryIds))]
+		var product *database.Product
+		product, err = database.QueryRandomProductInCategory(ctx, db, cfg.AccountId, categoryId, "")
+		if product != nil {
+			rs.addProduct(product, &Provenance{Trait: t.String(), Person: origPerson.MonetateId})
+		}
+	}
+	return
+}
+
+// number of similar products added at a time
+const similarProducts = 3
+
+type SimilarNameProductTrait struct{}
+
+func (t *SimilarNameProductTrait) String() string {
+	return "similar name product"
+}
+func (t *SimilarNameProductTrait) update(ctx context.Context, db *sql.DB, rs *RecoSet, cfg *Config,
+	origPerson *database.Person) (err error) {
+
+	inProduct := randomProduct(rs.products)
+	if inProduct == nil {
+		return
+	}
+	for _, m := range cfg.names.Similar(inProduct.Pid, similarProducts) {
+		rs.addProduct(m.Product, &Provenance{Trait: t.String(), Product: inProduct.Pid})
+	}
+	return
+}
+
+const (
+	coOccurrenceNeighbours = 20 // heaviest neighbours to sample from
+	coOccurrenceSamples    = 2  // neighbours added at a time
+)
+
+// sampleNeighbours picks up to n distinct neighbours, each with probability proportional to
+// its weight.
+func sampleNeighbours(neighbours []*database.Neighbour, n int) (sampled []*database.Neighbour) {
+	sampled = make([]*database.Neighbour, 0)
+	remaining := append([]*database.Neighbour{}, neighbours...)
+
+	for len(sampled) < n && len(remaining) > 0 {
+		total := 0.0
+		for _, nb := range remaining {
+			total += nb.Weight
+		}
+		if total <= 0.0 {
 			break
 		}
-		outProduct := database.QuerySoundAlikeProduct(db, accountId, inProduct)
-		if outProduct != nil {
-			rs.products[outProduct.Pid] = outProduct
+
+		r := rand.Float64() * total
+		i := 0
+		for ; i < len(remaining)-1; i++ {
+			r -= remaining[i].Weight
+			if r < 0.0 {
+				break
+			}
 		}
+		sampled = append(sampled, remaining[i])
+		remaining = append(remaining[:i], remaining[i+1:]...)
+	}
+	return
+}
+
+type CoOccurringProductTrait struct{}
+
+func (t *CoOccurringProductTrait) String() string {
+	return "co-occurring product"
+}
+func (t *CoOccurringProductTrait) update(ctx context.Context, db *sql.DB, rs *RecoSet, cfg *Config,
+	origPerson *database.Person) (err error) {
+
+	inProduct := randomProduct(rs.products)
+	if inProduct == nil {
+		return
+	}
+	neighbours, err := database.QueryProductNeighbours(ctx, db, cfg.AccountId, inProduct,
+		coOccurrenceNeighbours)
+	if err != nil {
+		return
+	}
+	for _, nb := range sampleNeighbours(neighbours, coOccurrenceSamples) {
+		rs.addProduct(nb.Product, &Provenance{Trait: t.String(), Product: inProduct.Pid})
+	}
+	return
+}
+
+const (
+	recentlyViewed          = 5 // how far back in the person's views to look
+	recentlyViewedPerPerson = 2 // products taken from each person found through a recent view
+	nextViewedNeighbours    = 10
+	nextViewedSamples       = 2
+)
+
+// RecentlyViewedExpansionTrait expands from one of the last few products the person viewed,
+// adding products viewed by other people who also viewed it.
+type RecentlyViewedExpansionTrait struct{}
+
+func (t *RecentlyViewedExpansionTrait) String() string {
+	return "recently viewed expansion"
+}
+func (t *RecentlyViewedExpansionTrait) update(ctx context.Context, db *sql.DB, rs *RecoSet,
+	cfg *Config, origPerson *database.Person) (err error) {
+
+	recent, err := database.QueryRecentlyViewedProducts(ctx, db, cfg.AccountId, origPerson,
+		recentlyViewed)
+	if err != nil || len(recent) == 0 {
+		return
+	}
+	inProduct := recent[rand.Intn(len(recent))]
+
+	products := map[string]*database.Product{inProduct.Pid: inProduct}
+	people, err := database.QueryPeopleThatViewedProducts(ctx, db, cfg.AccountId, products,
+		cfg.decay)
+	if err != nil {
+		return
+	}
+	for _, person := range people {
+		viewed, err := database.QuerySampledProductsViewed(ctx, db, cfg.AccountId, person,
+			recentlyViewedPerPerson, cfg.decay)
+		if err != nil {
+			return err
+		}
+		for _, p := range viewed {
+			if p.Pid != inProduct.Pid {
+				rs.addProduct(p, &Provenance{Trait: t.String(), Person: person.MonetateId,
+					Product: inProduct.Pid})
+			}
+		}
+	}
+	return
+}
+
+// NextViewedProductTrait adds products that people tend to view next after one of the
+// products in the set, using first order transition probabilities from the event streams.
+type NextViewedProductTrait struct{}
+
+func (t *NextViewedProductTrait) String() string {
+	return "next viewed product"
+}
+func (t *NextViewedProductTrait) update(ctx context.Context, db *sql.DB, rs *RecoSet, cfg *Config,
+	origPerson *database.Person) (err error) {
+
+	inProduct := randomProduct(rs.products)
+	if inProduct == nil {
+		return
+	}
+	neighbours, err := database.QueryNextViewedProducts(ctx, db, cfg.AccountId, inProduct,
+		nextViewedNeighbours)
+	if err != nil {
+		return
+	}
+	for _, nb := range sampleNeighbours(neighbours, nextViewedSamples) {
+		rs.addProduct(nb.Product, &Provenance{Trait: t.String(), Product: inProduct.Pid})
 	}
+	return
 }
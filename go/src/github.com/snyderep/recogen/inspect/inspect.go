@@ -0,0 +1,135 @@
+// Package inspect reports on the quality of each account's data, before any time is spent
+// evolving recommendations from it.
+package inspect
+
+import (
+	"context"
+	"fmt"
+	"github.com/snyderep/recogen/database"
+	"math"
+	"sort"
+)
+
+// the upper bounds of the conversion rate buckets, the same steps the fitness function uses.
+// Loaded rates can be above 1.0, they go in one more bucket that has no upper bound.
+var conversionBuckets = []float64{0.0, 0.25, 0.5, 0.75, 1.0}
+
+// Run prints a report for every account, read from the loaded tables or, if fromFiles is set,
+// straight from the data files.
+func Run(ctx context.Context,
+	fromFiles bool) (stats map[int64]*database.AccountStats, err error) {
+
+	if fromFiles {
+		stats = database.InspectFiles()
+	} else {
+		db := database.OpenDB()
+		defer db.Close()
+		stats, err = database.InspectTables(ctx, db)
+		if err != nil {
+			return
+		}
+	}
+
+	accountIds := make([]int64, 0)
+	for accountId, _ := range stats {
+		accountIds = append(accountIds, accountId)
+	}
+	sort.Sort(byAccountId(accountIds))
+
+	for _, accountId := range accountIds {
+		display(stats[accountId])
+	}
+
+	return
+}
+
+func display(as *database.AccountStats) {
+	fmt.Printf("********** ACCOUNT %d **********\n", as.AccountId)
+	fmt.Printf("%-36s %d\n", "products", as.Products)
+	fmt.Printf("%-36s %d\n", "products without a name", as.ProductsWithoutName)
+	fmt.Printf("%-36s %d\n", "products without an image", as.ProductsWithoutImage)
+	fmt.Printf("%-36s %d\n", "visitors", as.Visitors())
+	fmt.Printf("%-36s %s\n", "views per viewing visitor", describe(countValues(as.ViewsPerVisitor)))
+	fmt.Printf("%-36s %s\n", "purchases per purchasing visitor",
+		describe(countValues(as.PurchasesPerVisitor)))
+	fmt.Printf("%-36s %d\n", "viewed products without conversion", as.ViewedWithoutRate)
+	fmt.Printf("%-36s %s\n", "conversion rates", describe(as.ConversionRates))
+	for i, bound := range conversionBuckets {
+		label := fmt.Sprintf("  = %.2f", bound)
+		if i > 0 {
+			label = fmt.Sprintf("  %.2f - %.2f", conversionBuckets[i-1], bound)
+		}
+		fmt.Printf("%-36s %d\n", label, bucketCount(as.ConversionRates, i))
+	}
+	fmt.Printf("%-36s %d\n", fmt.Sprintf("  > %.2f", conversionBuckets[len(conversionBuckets)-1]),
+		bucketCount(as.ConversionRates, len(conversionBuckets)))
+	fmt.Printf("%-36s %d\n", "view rows with unknown pids", as.UnknownPidViews)
+	fmt.Printf("%-36s %d\n", "purchase rows with unknown pids", as.UnknownPidPurchases)
+	fmt.Printf("%-36s %d\n", "conversion rates with unknown pids", as.UnknownPidConversions)
+	if as.BadRows > 0 {
+		fmt.Printf("%-36s %d\n", "rows that wouldn't load", as.BadRows)
+	}
+}
+
+// bucketCount counts the rates in the bucket, the first bucket holds only zero and the others
+// run from just above the previous bound up to their own. The bucket after the last bound
+// holds everything above it.
+func bucketCount(rates []float64, bucket int) (count int) {
+	for _, rate := range rates {
+		if bucket == 0 {
+			if rate <= conversionBuckets[0] {
+				count += 1
+			}
+		} else if bucket == len(conversionBuckets) {
+			if rate > conversionBuckets[bucket-1] {
+				count += 1
+			}
+		} else if rate > conversionBuckets[bucket-1] && rate <= conversionBuckets[bucket] {
+			count += 1
+		}
+	}
+	return
+}
+
+func countValues(counts map[string]int64) (values []float64) {
+	values = make([]float64, 0)
+	for _, c := range counts {
+		values = append(values, float64(c))
+	}
+	return
+}
+
+// describe summarises a distribution as its size, mean and quantiles.
+func describe(values []float64) string {
+	if len(values) == 0 {
+		return "none"
+	}
+	sorted := make([]float64, len(values))
+	copy(sorted, values)
+	sort.Float64s(sorted)
+
+	sum := 0.0
+	for _, v := range sorted {
+		sum += v
+	}
+
+	return fmt.Sprintf("n=%d mean=%.3g min=%.3g p25=%.3g p50=%.3g p75=%.3g p90=%.3g max=%.3g",
+		len(sorted), sum/float64(len(sorted)), sorted[0], quantile(sorted, 0.25),
+		quantile(sorted, 0.5), quantile(sorted, 0.75), quantile(sorted, 0.9),
+		sorted[len(sorted)-1])
+}
+
+// quantile returns the nearest rank quantile of the sorted values.
+func quantile(sorted []float64, q float64) float64 {
+	i := int(math.Ceil(q*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+type byAccountId []int64
+
+func (a byAccountId) Len() int           { return len(a) }
+func (a byAccountId) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byAccountId) Less(i, j int) bool { return a[i] < a[j] }
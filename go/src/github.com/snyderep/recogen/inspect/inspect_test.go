@@ -0,0 +1,31 @@
+package inspect
+
+import "testing"
+
+func TestBucketCountsAddUp(t *testing.T) {
+	tests := []struct {
+		name  string
+		rates []float64
+		want  []int
+	}{
+		{"none", []float64{}, []int{0, 0, 0, 0, 0, 0}},
+		{"bounds", []float64{0.0, 0.25, 0.5, 0.75, 1.0}, []int{1, 1, 1, 1, 1, 0}},
+		{"between", []float64{0.1, 0.3, 0.6, 0.9}, []int{0, 1, 1, 1, 1, 0}},
+		{"above one", []float64{1.0001, 1.25, 40.0}, []int{0, 0, 0, 0, 0, 3}},
+		{"mixed", []float64{0.0, 0.2, 0.2, 1.0, 1.5}, []int{1, 2, 0, 0, 1, 1}},
+	}
+
+	for _, test := range tests {
+		total := 0
+		for bucket, want := range test.want {
+			got := bucketCount(test.rates, bucket)
+			if got != want {
+				t.Errorf("%s: bucket %d has %d, want %d", test.name, bucket, got, want)
+			}
+			total += got
+		}
+		if total != len(test.rates) {
+			t.Errorf("%s: buckets hold %d of %d rates", test.name, total, len(test.rates))
+		}
+	}
+}
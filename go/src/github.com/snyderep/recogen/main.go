@@ -1,23 +1,265 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
+	"fmt"
 	"github.com/snyderep/recogen/database"
+	"github.com/snyderep/recogen/evaluate"
 	"github.com/snyderep/recogen/gene"
+	"github.com/snyderep/recogen/inspect"
+	"github.com/snyderep/recogen/reco"
+	"github.com/snyderep/recogen/rules"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 var loadData bool
+var runEvaluation bool
+var buildCoOccurrences bool
+var buildConversionRates bool
+var priorViews float64
+var saveRecos bool
+var showLatest bool
+var runInspect bool
+var inspectFiles bool
+var migrateCmd string
+var accountId int64
+var monetateId string
+var maxPopulation int
+var maxGenerations int
+var sample int
+var topK int
+var holdOut float64
+var split string
+var cutoffDay string
+var maxRejectRate float64
+var scorerName string
+var jsonPath string
+var rulesPath string
+var diversityWeight float64
+var noveltyWeight float64
+var halfLife float64
+var fallbackAfter time.Duration
 
 func init() {
+	flag.StringVar(&database.DSN, "db", database.DSN,
+		"postgresql connection string, or a sqlite file ending in .db or starting with sqlite:")
+	flag.IntVar(&database.Pool.MaxOpenConns, "maxconns", database.Pool.MaxOpenConns,
+		"most database connections open at once, 0 for no limit")
+	flag.DurationVar(&database.QueryTimeout, "timeout", database.QueryTimeout,
+		"longest any one query can run, 0 for no limit")
 	flag.BoolVar(&loadData, "load", false, "load all data")
+	flag.BoolVar(&buildCoOccurrences, "cooccur", false, "precompute product co-occurrences from the loaded data")
+	flag.BoolVar(&buildConversionRates, "conversion", false,
+		"compute product conversion rates from the loaded views and purchases")
+	flag.Float64Var(&priorViews, "prior", 50,
+		"views at the account's conversion rate added to every product's when computing its rate")
+	flag.BoolVar(&runEvaluation, "evaluate", false, "evaluate the recommenders against held out purchases")
+	flag.BoolVar(&saveRecos, "save", false, "save the recommendations to the database")
+	flag.BoolVar(&showLatest, "latest", false, "show the latest saved recommendations")
+	flag.StringVar(&migrateCmd, "migrate", "", "migrate the schema: up, down or status")
+	flag.BoolVar(&runInspect, "inspect", false, "report on the quality of each account's data")
+	flag.BoolVar(&inspectFiles, "files", false, "inspect the data files rather than the loaded tables")
+	flag.Int64Var(&accountId, "account", 321, "account id")
+	flag.StringVar(&monetateId, "visitor", "2.1001298975.1355107162879", "monetate id of the visitor")
+	flag.IntVar(&maxPopulation, "population", 25, "maximum population size")
+	flag.IntVar(&maxGenerations, "generations", 50, "number of generations to evolve")
+	flag.IntVar(&sample, "sample", 20, "number of visitors to evaluate")
+	flag.IntVar(&topK, "k", 10, "number of recommendations to keep")
+	flag.StringVar(&scorerName, "rank", "conversion",
+		"how to rank the recommendations: conversion, price, co-occurrence or margin")
+	flag.StringVar(&rulesPath, "rules", "", "JSON file of business rules, keyed by account id")
+	flag.Float64Var(&diversityWeight, "diversity", gene.DefaultWeights.Diversity, "fitness weight of diversity")
+	flag.Float64Var(&noveltyWeight, "novelty", gene.DefaultWeights.Novelty, "fitness weight of novelty")
+	flag.Float64Var(&halfLife, "halflife", 0, "days for an interaction's weight to halve, 0 for no decay")
+	flag.DurationVar(&fallbackAfter, "fallback", 0,
+		"give up on the evolver after this long and recommend the blend of simpler recommenders instead, 0 never to")
+	flag.StringVar(&jsonPath, "json", "", "also write the recommendations, with explanations, to this file as JSON")
+	flag.Float64Var(&holdOut, "holdout", 0.5, "fraction of the evaluated purchases to hide")
+	flag.StringVar(&split, "split", evaluate.VisitorSplit,
+		"how to hide purchases from the evaluated recommenders: visitor or time")
+	flag.StringVar(&cutoffDay, "cutoff", "",
+		"yyyy-mm-dd, the time split hides everything from this day on, by default the day "+
+			"that leaves the holdout fraction of purchases on or after it")
+	flag.Float64Var(&maxRejectRate, "maxreject", 1.0,
+		"fraction of a data file's rows that can be rejected before the load is aborted")
 }
 
 func main() {
 	flag.Parse()
 
-	if loadData {
-		database.LoadAllData()
+	scorer := gene.GetScorer(scorerName)
+	if scorer == nil {
+		fmt.Printf("unknown ranking: %s\n", scorerName)
+		os.Exit(2)
+	}
+
+	// the first Ctrl-C stops the run cleanly, keeping whatever it's found so far, and a
+	// second one kills it
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		signal.Stop(signals)
+		cancel(gene.ErrStopped)
+	}()
+
+	var err error
+	if migrateCmd != "" {
+		err = migrate(ctx, migrateCmd)
+	} else if loadData {
+		err = database.LoadAllData(ctx, maxRejectRate)
+	} else if buildCoOccurrences {
+		db := database.OpenDB()
+		defer db.Close()
+		err = database.BuildProductCoOccurrences(ctx, db)
+	} else if buildConversionRates {
+		db := database.OpenDB()
+		defer db.Close()
+		err = database.BuildProductConversionRates(ctx, db, priorViews)
+	} else if runEvaluation {
+		cfg := &evaluate.Config{AccountId: accountId, Sample: sample, K: topK, HoldOut: holdOut,
+			Split: split, MaxPopulation: maxPopulation, MaxGenerations: maxGenerations,
+			Fallback: fallbackAfter}
+		if cutoffDay != "" {
+			cfg.Cutoff, err = time.Parse("2006-01-02", cutoffDay)
+		}
+		if err == nil {
+			_, err = evaluate.Run(ctx, cfg)
+		}
+	} else if showLatest {
+		err = displayLatest(ctx)
+	} else if runInspect {
+		_, err = inspect.Run(ctx, inspectFiles)
 	} else {
-		gene.Run(25, 50, 321, "2.1001298975.1355107162879")
+		cfg := &gene.Config{AccountId: accountId, MonetateId: monetateId,
+			MaxPopulation: maxPopulation, MaxGenerations: maxGenerations, Scorer: scorer,
+			TopK: topK, Save: saveRecos, HalfLife: halfLife}
+		weights := gene.DefaultWeights
+		weights.Diversity = diversityWeight
+		weights.Novelty = noveltyWeight
+		cfg.Weights = &weights
+		if rulesPath != "" {
+			var accountRules map[int64]*rules.Rules
+			accountRules, err = rules.Load(rulesPath)
+			cfg.Rules = accountRules[accountId]
+		}
+		var ranked []*gene.RankedProduct
+		if err == nil && fallbackAfter > 0 {
+			ranked, err = recommendWithFallback(ctx, cfg)
+		} else if err == nil {
+			ranked, err = gene.Run(ctx, cfg)
+		}
+		if err == nil && jsonPath != "" {
+			writeJSON(ranked)
+		}
+	}
+
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+// recommendWithFallback runs the evolver, or the default blend if it takes longer than
+// fallbackAfter. Only the evolver's recommendations are saved and explained, the blend's are
+// returned without explanations.
+func recommendWithFallback(ctx context.Context, cfg *gene.Config) (ranked []*gene.RankedProduct,
+	err error) {
+
+	db := database.OpenDB()
+	defer db.Close()
+
+	evolver := &gene.Evolver{Config: *cfg}
+	r := &reco.Fallback{Primary: evolver, Secondary: reco.DefaultBlend(), Timeout: fallbackAfter}
+	products, err := r.Recommend(ctx, db, cfg.AccountId,
+		&database.Person{MonetateId: cfg.MonetateId}, cfg.TopK)
+	if err != nil {
+		return
+	}
+	if len(evolver.Ranked) > 0 {
+		ranked = evolver.Ranked
+		return
+	}
+
+	ranked = make([]*gene.RankedProduct, 0)
+	for i, p := range products {
+		fmt.Printf("%d. %s (%s)\n", i+1, p.Name, p.Pid)
+		ranked = append(ranked, &gene.RankedProduct{Product: p})
+	}
+	return
+}
+
+func displayLatest(ctx context.Context) (err error) {
+	db := database.OpenDB()
+	defer db.Close()
+
+	run, recos, err := database.QueryLatestRecommendations(ctx, db, accountId,
+		&database.Person{MonetateId: monetateId})
+	if err != nil {
+		return
+	}
+	if run == nil {
+		fmt.Println("no saved recommendations")
+		return
+	}
+
+	fmt.Printf("run %d, generated %s, score: %f\n", run.RunId, run.FinishedAt, run.Score)
+	fmt.Printf("population %d, generations %d, ranked by %s, top %d, half life %g days\n",
+		run.MaxPopulation, run.MaxGenerations, run.Scorer, run.TopK, run.HalfLife)
+	fmt.Printf("weights: %s\n", run.Weights)
+	if run.Rules != "" {
+		fmt.Printf("rules: %s\n", run.Rules)
+	}
+	for _, r := range recos {
+		fmt.Printf("%d. %s (%s)\n", r.Rank, r.Product.Name, r.Product.Pid)
+	}
+	return
+}
+
+func writeJSON(ranked []*gene.RankedProduct) {
+	file, err := os.Create(jsonPath)
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	result := struct {
+		AccountId       int64                 `json:"account_id"`
+		MonetateId      string                `json:"monetate_id"`
+		Recommendations []*gene.RankedProduct `json:"recommendations"`
+	}{accountId, monetateId, ranked}
+
+	encoder := json.NewEncoder(file)
+	err = encoder.Encode(result)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func migrate(ctx context.Context, cmd string) (err error) {
+	db := database.OpenDB()
+	defer db.Close()
+
+	switch cmd {
+	case "up":
+		err = database.MigrateUp(ctx, db)
+	case "down":
+		err = database.MigrateDown(ctx, db)
+	case "status":
+	default:
+		fmt.Printf("unknown migration command: %s\n", cmd)
+		os.Exit(2)
+	}
+	if err != nil {
+		return
 	}
+	err = database.DisplayMigrationStatus(ctx, db)
+	return
 }
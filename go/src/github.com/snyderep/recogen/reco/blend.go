@@ -0,0 +1,90 @@
+package reco
+
+import (
+	"context"
+	"database/sql"
+	"github.com/snyderep/recogen/database"
+	"sort"
+	"strings"
+)
+
+// Blend combines the ranked lists of several recommenders. Each product scores
+// weight / rank for every list it appears in and the products are ordered by total score.
+type Blend struct {
+	Recommenders []Recommender
+	Weights      []float64
+}
+
+// DefaultBlend mixes co-viewed and co-purchased products with the most popular ones, which
+// fill in for people without much history.
+func DefaultBlend() *Blend {
+	return &Blend{Recommenders: []Recommender{&CoView{}, &CoPurchase{}, &Popularity{}},
+		Weights: []float64{1.0, 1.0, 0.5}}
+}
+
+func (r *Blend) String() string {
+	names := []string{}
+	for _, rec := range r.Recommenders {
+		names = append(names, rec.String())
+	}
+	return "blend(" + strings.Join(names, ", ") + ")"
+}
+
+type blendedProduct struct {
+	product *database.Product
+	score   float64
+}
+
+type byBlendedScore []*blendedProduct
+
+func (b byBlendedScore) Len() int {
+	return len(b)
+}
+func (b byBlendedScore) Swap(i, j int) {
+	b[i], b[j] = b[j], b[i]
+}
+func (b byBlendedScore) Less(i, j int) bool {
+	if b[i].score == b[j].score {
+		return b[i].product.Pid < b[j].product.Pid
+	}
+	return b[i].score > b[j].score
+}
+
+func (r *Blend) Recommend(ctx context.Context, db *sql.DB, accountId int64,
+	person *database.Person, k int) (products []*database.Product, err error) {
+
+	blended := make(map[string]*blendedProduct)
+
+	for i, rec := range r.Recommenders {
+		weight := 1.0
+		if i < len(r.Weights) {
+			weight = r.Weights[i]
+		}
+
+		var recommended []*database.Product
+		recommended, err = rec.Recommend(ctx, db, accountId, person, k)
+		if err != nil {
+			return
+		}
+		for rank, p := range recommended {
+			b, ok := blended[p.Pid]
+			if !ok {
+				b = &blendedProduct{product: p}
+				blended[p.Pid] = b
+			}
+			b.score += weight / float64(rank+1)
+		}
+	}
+
+	ordered := make([]*blendedProduct, 0)
+	for _, b := range blended {
+		ordered = append(ordered, b)
+	}
+	sort.Sort(byBlendedScore(ordered))
+
+	products = make([]*database.Product, 0)
+	for i := 0; i < len(ordered) && i < k; i++ {
+		products = append(products, ordered[i].product)
+	}
+	return
+}
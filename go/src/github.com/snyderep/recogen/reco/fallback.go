@@ -0,0 +1,57 @@
+package reco
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/snyderep/recogen/database"
+	"time"
+)
+
+// Fallback uses Primary unless it takes longer than Timeout, in which case the Secondary
+// recommendations are returned instead. Secondary is also used when Primary fails or comes
+// back empty. Primary is given a context that ends after Timeout, and has to stop when it
+// does. A Timeout of 0 never gives up on Primary.
+type Fallback struct {
+	Primary   Recommender
+	Secondary Recommender
+	Timeout   time.Duration
+}
+
+func (r *Fallback) String() string {
+	return r.Primary.String() + " falling back to " + r.Secondary.String()
+}
+func (r *Fallback) Recommend(ctx context.Context, db *sql.DB, accountId int64,
+	person *database.Person, k int) (products []*database.Product, err error) {
+
+	var primaryCtx context.Context
+	var cancel context.CancelFunc
+	if r.Timeout > 0 {
+		primaryCtx, cancel = context.WithTimeout(ctx, r.Timeout)
+	} else {
+		primaryCtx, cancel = context.WithCancel(ctx)
+	}
+	defer cancel()
+
+	// waited for rather than abandoned, so that nothing the primary does outlives the call
+	products, err = r.Primary.Recommend(primaryCtx, db, accountId, person, k)
+	if err == nil && len(products) > 0 {
+		return
+	}
+	// the caller has given up, or stopped the primary early and wants whatever it found
+	if ctx.Err() != nil {
+		return
+	}
+
+	switch {
+	case primaryCtx.Err() == context.DeadlineExceeded:
+		fmt.Printf("%s timed out, using %s\n", r.Primary.String(), r.Secondary.String())
+	case err != nil:
+		fmt.Printf("%s failed: %v, using %s\n", r.Primary.String(), err, r.Secondary.String())
+	default:
+		fmt.Printf("%s found nothing, using %s\n", r.Primary.String(), r.Secondary.String())
+	}
+
+	products, err = r.Secondary.Recommend(ctx, db, accountId, person, k)
+	return
+}
@@ -0,0 +1,131 @@
+package reco
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/snyderep/recogen/database"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// stub recommends its pids, after waiting for delay unless the context ends first, or fails
+// with err.
+type stub struct {
+	name  string
+	pids  []string
+	delay time.Duration
+	err   error
+}
+
+func (r *stub) String() string {
+	return r.name
+}
+func (r *stub) Recommend(ctx context.Context, db *sql.DB, accountId int64,
+	person *database.Person, k int) (products []*database.Product, err error) {
+
+	if r.delay > 0 {
+		select {
+		case <-time.After(r.delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	products = make([]*database.Product, 0)
+	for _, pid := range r.pids {
+		products = append(products, &database.Product{Pid: pid})
+	}
+	return
+}
+
+func pids(products []*database.Product) (pids []string) {
+	pids = make([]string, 0)
+	for _, p := range products {
+		pids = append(pids, p.Pid)
+	}
+	return
+}
+
+func TestFallback(t *testing.T) {
+	secondary := &stub{name: "secondary", pids: []string{"s"}}
+	tests := []struct {
+		name    string
+		primary *stub
+		timeout time.Duration
+		want    []string
+	}{
+		{"primary", &stub{name: "primary", pids: []string{"p"}}, time.Second, []string{"p"}},
+		{"no timeout", &stub{name: "primary", pids: []string{"p"}, delay: 10 * time.Millisecond},
+			0, []string{"p"}},
+		{"timed out", &stub{name: "primary", pids: []string{"p"}, delay: time.Second},
+			10 * time.Millisecond, []string{"s"}},
+		{"failed", &stub{name: "primary", err: errors.New("broken")}, time.Second,
+			[]string{"s"}},
+		{"empty", &stub{name: "primary"}, time.Second, []string{"s"}},
+	}
+
+	for _, test := range tests {
+		r := &Fallback{Primary: test.primary, Secondary: secondary, Timeout: test.timeout}
+		products, err := r.Recommend(context.Background(), nil, 1, &database.Person{}, 10)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if got := pids(products); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestFallbackCallerCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := &Fallback{Primary: &stub{name: "primary", delay: time.Second},
+		Secondary: &stub{name: "secondary", pids: []string{"s"}}, Timeout: time.Minute}
+	products, err := r.Recommend(ctx, nil, 1, &database.Person{}, 10)
+	if err == nil || len(products) > 0 {
+		t.Errorf("got %v and %v, want the cancellation and nothing from the secondary",
+			pids(products), err)
+	}
+}
+
+func TestBlend(t *testing.T) {
+	a := &stub{name: "a", pids: []string{"1", "2", "3"}}
+	b := &stub{name: "b", pids: []string{"3", "4"}}
+	tests := []struct {
+		name    string
+		weights []float64
+		k       int
+		want    []string
+	}{
+		// 1: 1, 2: 1/2, 3: 1/3 + 1, 4: 1/2, ties go to the lower pid
+		{"equal weights", nil, 10, []string{"3", "1", "2", "4"}},
+		{"cut to k", nil, 2, []string{"3", "1"}},
+		// 1: 1, 2: 1/2, 3: 1/3 + 1/4, 4: 1/8
+		{"weighted", []float64{1.0, 0.25}, 10, []string{"1", "3", "2", "4"}},
+		// b's weight defaults to 1, so 1: 3, 2: 3/2, 3: 1 + 1, 4: 1/2
+		{"missing weight", []float64{3.0}, 10, []string{"1", "3", "2", "4"}},
+	}
+
+	for _, test := range tests {
+		r := &Blend{Recommenders: []Recommender{a, b}, Weights: test.weights}
+		products, err := r.Recommend(context.Background(), nil, 1, &database.Person{}, test.k)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if got := pids(products); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	r := &Blend{Recommenders: []Recommender{a, &stub{name: "b", err: errors.New("broken")}}}
+	_, err := r.Recommend(context.Background(), nil, 1, &database.Person{}, 10)
+	if err == nil {
+		t.Error("a blend with a failing recommender didn't fail")
+	}
+}
@@ -0,0 +1,64 @@
+// Package reco defines the Recommender interface along with simple recommenders built
+// directly on the loaded data, for comparison with and as a fallback for the evolver.
+package reco
+
+import (
+	"context"
+	"database/sql"
+	"github.com/snyderep/recogen/database"
+)
+
+type Recommender interface {
+	String() string
+	Recommend(ctx context.Context, db *sql.DB, accountId int64, person *database.Person,
+		k int) ([]*database.Product, error)
+}
+
+// Popularity recommends the products with the most views across all visitors.
+type Popularity struct{}
+
+func (r *Popularity) String() string {
+	return "most popular"
+}
+func (r *Popularity) Recommend(ctx context.Context, db *sql.DB, accountId int64,
+	person *database.Person, k int) ([]*database.Product, error) {
+
+	return database.QueryMostViewedProducts(ctx, db, accountId, k)
+}
+
+// TopConversion recommends the products with the highest global conversion rates.
+type TopConversion struct{}
+
+func (r *TopConversion) String() string {
+	return "top conversion"
+}
+func (r *TopConversion) Recommend(ctx context.Context, db *sql.DB, accountId int64,
+	person *database.Person, k int) ([]*database.Product, error) {
+
+	return database.QueryTopConversionProducts(ctx, db, accountId, k)
+}
+
+// CoView recommends the products viewed by the people that viewed what the person viewed.
+type CoView struct{}
+
+func (r *CoView) String() string {
+	return "co-view"
+}
+func (r *CoView) Recommend(ctx context.Context, db *sql.DB, accountId int64,
+	person *database.Person, k int) ([]*database.Product, error) {
+
+	return database.QueryCoViewedProducts(ctx, db, accountId, person, k)
+}
+
+// CoPurchase recommends the products purchased by the people that purchased what the
+// person viewed or purchased.
+type CoPurchase struct{}
+
+func (r *CoPurchase) String() string {
+	return "co-purchase"
+}
+func (r *CoPurchase) Recommend(ctx context.Context, db *sql.DB, accountId int64,
+	person *database.Person, k int) ([]*database.Product, error) {
+
+	return database.QueryCoPurchasedProducts(ctx, db, accountId, person, k)
+}
@@ -0,0 +1,241 @@
+// Package rules filters recommended products according to business rules that are
+// configured per account.
+package rules
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/snyderep/recogen/database"
+	"os"
+	"strconv"
+)
+
+// Rules is the configuration for one account. Zero values turn a rule off.
+type Rules struct {
+	Include          []string `json:"include"`           // if not empty only these pids are allowed
+	Exclude          []string `json:"exclude"`           // pids that are never allowed
+	MinPrice         float64  `json:"min_price"`         // lowest allowed unit price
+	MaxPrice         float64  `json:"max_price"`         // highest allowed unit price
+	RequireImage     bool     `json:"require_image"`     // drop products without an image url
+	MaxPerCategory   int      `json:"max_per_category"`  // most products allowed from one category
+	ExcludePurchased bool     `json:"exclude_purchased"` // drop products the person already purchased
+}
+
+// A Rule removes products from a list, keeping the order of the products it doesn't remove.
+type Rule interface {
+	String() string
+	apply(context.Context, *sql.DB, int64, *database.Person,
+		[]*database.Product) ([]*database.Product, error)
+}
+
+// Load reads the rules for every account from a JSON file, an object keyed by account id.
+// A rule that isn't known or can't be met is an error naming the file and the rule.
+func Load(path string) (accountRules map[int64]*Rules, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	raw := make(map[string]*Rules)
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&raw)
+	if err != nil {
+		err = fmt.Errorf("%s: %w", path, err)
+		return
+	}
+
+	accountRules = make(map[int64]*Rules)
+	for key, r := range raw {
+		accountId, parseErr := strconv.ParseInt(key, 10, 64)
+		if parseErr != nil {
+			err = fmt.Errorf("%s: account id %q is not an integer", path, key)
+			return
+		}
+		if r == nil {
+			r = &Rules{}
+		}
+		err = r.check()
+		if err != nil {
+			err = fmt.Errorf("%s: account %d: %w", path, accountId, err)
+			return
+		}
+		accountRules[accountId] = r
+	}
+	return
+}
+
+// check returns an error naming the first rule whose value makes no sense.
+func (r *Rules) check() (err error) {
+	switch {
+	case r.MinPrice < 0.0:
+		err = fmt.Errorf("min_price %v is negative", r.MinPrice)
+	case r.MaxPrice < 0.0:
+		err = fmt.Errorf("max_price %v is negative", r.MaxPrice)
+	case r.MaxPrice > 0.0 && r.MinPrice > r.MaxPrice:
+		err = fmt.Errorf("min_price %v is above max_price %v", r.MinPrice, r.MaxPrice)
+	case r.MaxPerCategory < 0:
+		err = fmt.Errorf("max_per_category %d is negative", r.MaxPerCategory)
+	}
+	return
+}
+
+func (r *Rules) getRules() (rules []Rule) {
+	rules = make([]Rule, 0)
+	if len(r.Include) > 0 {
+		rules = append(rules, &IncludeRule{pids: toSet(r.Include)})
+	}
+	if len(r.Exclude) > 0 {
+		rules = append(rules, &ExcludeRule{pids: toSet(r.Exclude)})
+	}
+	if r.MinPrice > 0.0 || r.MaxPrice > 0.0 {
+		rules = append(rules, &PriceBandRule{min: r.MinPrice, max: r.MaxPrice})
+	}
+	if r.RequireImage {
+		rules = append(rules, &RequireImageRule{})
+	}
+	if r.ExcludePurchased {
+		rules = append(rules, &ExcludePurchasedRule{})
+	}
+	// last, so that only products that passed everything else count against the limit
+	if r.MaxPerCategory > 0 {
+		rules = append(rules, &MaxPerCategoryRule{max: r.MaxPerCategory})
+	}
+	return
+}
+
+// Filter applies every configured rule to the products. A nil Rules allows everything.
+func (r *Rules) Filter(ctx context.Context, db *sql.DB, accountId int64, person *database.Person,
+	products []*database.Product) (kept []*database.Product, err error) {
+
+	kept = products
+	if r == nil {
+		return
+	}
+	for _, rule := range r.getRules() {
+		kept, err = rule.apply(ctx, db, accountId, person, kept)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func toSet(pids []string) (set map[string]bool) {
+	set = make(map[string]bool)
+	for _, pid := range pids {
+		set[pid] = true
+	}
+	return
+}
+
+// keep returns the products that the function allows.
+func keep(products []*database.Product, allowed func(*database.Product) bool) (kept []*database.Product) {
+	kept = make([]*database.Product, 0)
+	for _, p := range products {
+		if allowed(p) {
+			kept = append(kept, p)
+		}
+	}
+	return
+}
+
+type IncludeRule struct {
+	pids map[string]bool
+}
+
+func (r *IncludeRule) String() string {
+	return "include"
+}
+func (r *IncludeRule) apply(ctx context.Context, db *sql.DB, accountId int64,
+	person *database.Person, products []*database.Product) ([]*database.Product, error) {
+
+	return keep(products, func(p *database.Product) bool { return r.pids[p.Pid] }), nil
+}
+
+type ExcludeRule struct {
+	pids map[string]bool
+}
+
+func (r *ExcludeRule) String() string {
+	return "exclude"
+}
+func (r *ExcludeRule) apply(ctx context.Context, db *sql.DB, accountId int64,
+	person *database.Person, products []*database.Product) ([]*database.Product, error) {
+
+	return keep(products, func(p *database.Product) bool { return !r.pids[p.Pid] }), nil
+}
+
+type PriceBandRule struct {
+	min float64
+	max float64 // 0 for no upper bound
+}
+
+func (r *PriceBandRule) String() string {
+	return "price band"
+}
+func (r *PriceBandRule) apply(ctx context.Context, db *sql.DB, accountId int64,
+	person *database.Person, products []*database.Product) ([]*database.Product, error) {
+
+	return keep(products, func(p *database.Product) bool {
+		return p.UnitPrice >= r.min && (r.max <= 0.0 || p.UnitPrice <= r.max)
+	}), nil
+}
+
+type RequireImageRule struct{}
+
+func (r *RequireImageRule) String() string {
+	return "require image"
+}
+func (r *RequireImageRule) apply(ctx context.Context, db *sql.DB, accountId int64,
+	person *database.Person, products []*database.Product) ([]*database.Product, error) {
+
+	return keep(products, func(p *database.Product) bool { return p.ImageUrl != "" }), nil
+}
+
+type ExcludePurchasedRule struct{}
+
+func (r *ExcludePurchasedRule) String() string {
+	return "exclude purchased"
+}
+func (r *ExcludePurchasedRule) apply(ctx context.Context, db *sql.DB, accountId int64,
+	person *database.Person, products []*database.Product) ([]*database.Product, error) {
+
+	kept := make([]*database.Product, 0)
+	for _, p := range products {
+		purchased, err := database.HasProductBeenPurchasedByPerson(ctx, db, accountId, person, p)
+		if err != nil {
+			return nil, err
+		}
+		if !purchased {
+			kept = append(kept, p)
+		}
+	}
+	return kept, nil
+}
+
+// MaxPerCategoryRule keeps the first max products of each category. Products without a
+// category aren't limited.
+type MaxPerCategoryRule struct {
+	max int
+}
+
+func (r *MaxPerCategoryRule) String() string {
+	return "max per category"
+}
+func (r *MaxPerCategoryRule) apply(ctx context.Context, db *sql.DB, accountId int64,
+	person *database.Person, products []*database.Product) ([]*database.Product, error) {
+
+	counts := make(map[string]int)
+	return keep(products, func(p *database.Product) bool {
+		c := p.CategoryId
+		if c == "" {
+			return true
+		}
+		counts[c] += 1
+		return counts[c] <= r.max
+	}), nil
+}
@@ -0,0 +1,109 @@
+package rules
+
+import (
+	"context"
+	"github.com/snyderep/recogen/database"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		want     map[int64]*Rules
+		err      string // what the error says after the file name, empty for none
+	}{
+		{"fine", `{"321": {"exclude": ["9"], "min_price": 5, "max_per_category": 2}}`,
+			map[int64]*Rules{321: {Exclude: []string{"9"}, MinPrice: 5, MaxPerCategory: 2}}, ""},
+		{"no rules", `{"321": {}}`, map[int64]*Rules{321: {}}, ""},
+		{"account", `{"shop": {}}`, nil, `account id "shop" is not an integer`},
+		{"unknown rule", `{"321": {"max_price": 10, "min_prize": 5}}`, nil,
+			`json: unknown field "min_prize"`},
+		{"wrong type", `{"321": {"min_price": "5"}}`, nil, "min_price"},
+		{"negative price", `{"321": {"min_price": -1}}`, nil,
+			"account 321: min_price -1 is negative"},
+		{"price band", `{"321": {"min_price": 20, "max_price": 10}}`, nil,
+			"account 321: min_price 20 is above max_price 10"},
+		{"no upper bound", `{"321": {"min_price": 20, "max_price": 0}}`,
+			map[int64]*Rules{321: {MinPrice: 20}}, ""},
+		{"per category", `{"321": {"max_per_category": -2}}`, nil,
+			"account 321: max_per_category -2 is negative"},
+		{"not json", `{"321": `, nil, "unexpected EOF"},
+	}
+
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "rules.json")
+		err := os.WriteFile(path, []byte(test.contents), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		accountRules, err := Load(path)
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("%s: %v", test.name, err)
+			} else if !reflect.DeepEqual(accountRules, test.want) {
+				t.Errorf("%s: got %v, want %v", test.name, accountRules, test.want)
+			}
+			continue
+		}
+		if err == nil || !strings.HasPrefix(err.Error(), path+": ") ||
+			!strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got %v, want an error naming %s and saying %q", test.name, err, path,
+				test.err)
+		}
+	}
+
+	_, err := Load(filepath.Join(t.TempDir(), "missing.json"))
+	if err == nil {
+		t.Error("loading a missing file didn't fail")
+	}
+}
+
+func TestFilter(t *testing.T) {
+	products := []*database.Product{
+		{Pid: "1", UnitPrice: 5, ImageUrl: "1.jpg", CategoryId: "a"},
+		{Pid: "2", UnitPrice: 15, ImageUrl: "2.jpg", CategoryId: "a"},
+		{Pid: "3", UnitPrice: 25, CategoryId: "a"},
+		{Pid: "4", UnitPrice: 35, ImageUrl: "4.jpg", CategoryId: "b"},
+		{Pid: "5", UnitPrice: 45, ImageUrl: "5.jpg"},
+	}
+	tests := []struct {
+		name  string
+		rules *Rules
+		want  []string
+	}{
+		{"nil", nil, []string{"1", "2", "3", "4", "5"}},
+		{"none", &Rules{}, []string{"1", "2", "3", "4", "5"}},
+		{"include", &Rules{Include: []string{"2", "4", "9"}}, []string{"2", "4"}},
+		{"exclude", &Rules{Exclude: []string{"2", "4"}}, []string{"1", "3", "5"}},
+		{"min price", &Rules{MinPrice: 20}, []string{"3", "4", "5"}},
+		{"price band", &Rules{MinPrice: 10, MaxPrice: 35}, []string{"2", "3", "4"}},
+		{"require image", &Rules{RequireImage: true}, []string{"1", "2", "4", "5"}},
+		{"per category", &Rules{MaxPerCategory: 1}, []string{"1", "4", "5"}},
+		// 1 is dropped by price before it can use up a's place
+		{"per category last", &Rules{MinPrice: 10, MaxPerCategory: 1}, []string{"2", "4", "5"}},
+		{"combined", &Rules{Exclude: []string{"2"}, RequireImage: true, MaxPerCategory: 1},
+			[]string{"1", "4", "5"}},
+	}
+
+	for _, test := range tests {
+		kept, err := test.rules.Filter(context.Background(), nil, 321, &database.Person{},
+			products)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		got := make([]string, 0)
+		for _, p := range kept {
+			got = append(got, p.Pid)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+// Package similarity finds products with similar names using TF-IDF weighted word vectors
+// and cosine similarity.
+package similarity
+
+import (
+	"github.com/snyderep/recogen/database"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+type Match struct {
+	Product *database.Product
+	Score   float64
+}
+
+type byScore []*Match
+
+func (b byScore) Len() int {
+	return len(b)
+}
+func (b byScore) Swap(i, j int) {
+	b[i], b[j] = b[j], b[i]
+}
+func (b byScore) Less(i, j int) bool {
+	if b[i].Score == b[j].Score {
+		return b[i].Product.Pid < b[j].Product.Pid
+	}
+	return b[i].Score > b[j].Score
+}
+
+// Index holds a normalized TF-IDF vector for every product name. It is read only once built
+// so it is safe to share between goroutines.
+type Index struct {
+	products map[string]*database.Product
+	vectors  map[string]map[string]float64 // term weights keyed by pid
+	postings map[string][]string           // pids keyed by term
+}
+
+// Words lower cases the name and splits it into words, on anything that isn't a letter or a
+// digit.
+func Words(name string) []string {
+	return strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// WordSet returns the distinct Words of the name.
+func WordSet(name string) (words map[string]bool) {
+	words = make(map[string]bool)
+	for _, w := range Words(name) {
+		words[w] = true
+	}
+	return
+}
+
+// Jaccard is the number of words two sets have in common over the number in either. Two empty
+// sets are the same.
+func Jaccard(a map[string]bool, b map[string]bool) float64 {
+	if len(a) == 0 && len(b) == 0 {
+		return 1.0
+	}
+	both := 0
+	for w, _ := range a {
+		if b[w] {
+			both += 1
+		}
+	}
+	return float64(both) / float64(len(a)+len(b)-both)
+}
+
+func NewIndex(products []*database.Product) (index *Index) {
+	index = &Index{products: make(map[string]*database.Product),
+		vectors:  make(map[string]map[string]float64),
+		postings: make(map[string][]string)}
+
+	// term frequencies per product and document frequencies per term
+	termCounts := make(map[string]map[string]float64)
+	docFreq := make(map[string]int)
+	for _, p := range products {
+		counts := make(map[string]float64)
+		for _, term := range Words(p.Name) {
+			counts[term] += 1.0
+		}
+		for term, _ := range counts {
+			docFreq[term] += 1
+			index.postings[term] = append(index.postings[term], p.Pid)
+		}
+		termCounts[p.Pid] = counts
+		index.products[p.Pid] = p
+	}
+
+	n := float64(len(products))
+	for pid, counts := range termCounts {
+		vector := make(map[string]float64)
+		norm := 0.0
+		for term, count := range counts {
+			w := count * math.Log(n/float64(docFreq[term]))
+			vector[term] = w
+			norm += w * w
+		}
+		norm = math.Sqrt(norm)
+		if norm > 0.0 {
+			for term, _ := range vector {
+				vector[term] /= norm
+			}
+		}
+		index.vectors[pid] = vector
+	}
+
+	return
+}
+
+// Similar returns up to n of the products whose names are most similar to the named product's,
+// most similar first. Products with nothing in common are never returned.
+func (index *Index) Similar(pid string, n int) (matches []*Match) {
+	matches = make([]*Match, 0)
+
+	vector, ok := index.vectors[pid]
+	if !ok {
+		return
+	}
+
+	// only products that share a term can have a non zero cosine
+	scores := make(map[string]float64)
+	for term, w := range vector {
+		for _, other := range index.postings[term] {
+			if other != pid {
+				scores[other] += w * index.vectors[other][term]
+			}
+		}
+	}
+
+	for other, score := range scores {
+		if score > 0.0 {
+			matches = append(matches, &Match{Product: index.products[other], Score: score})
+		}
+	}
+	sort.Sort(byScore(matches))
+
+	if len(matches) > n {
+		matches = matches[:n]
+	}
+	return
+}
@@ -0,0 +1,93 @@
+package similarity
+
+import (
+	"github.com/snyderep/recogen/database"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestWords(t *testing.T) {
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{"Silver Drop Earrings", []string{"silver", "drop", "earrings"}},
+		{"I &lt;3 JB Necklace", []string{"i", "lt", "3", "jb", "necklace"}},
+		{"  Koala-Bear  ", []string{"koala", "bear"}},
+		{"!!!", []string{}},
+	}
+
+	for _, test := range tests {
+		got := Words(test.name)
+		if len(got) == 0 && len(test.want) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestJaccard(t *testing.T) {
+	tests := []struct {
+		a    string
+		b    string
+		want float64
+	}{
+		{"silver drop earrings", "Silver Drop Earrings", 1.0},
+		{"silver drop earrings", "gold drop earrings", 0.5},
+		{"silver earrings", "koala necklace", 0.0},
+		{"", "", 1.0},
+		{"", "koala", 0.0},
+	}
+
+	for _, test := range tests {
+		if got := Jaccard(WordSet(test.a), WordSet(test.b)); got != test.want {
+			t.Errorf("%q and %q: got %f, want %f", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestSimilar(t *testing.T) {
+	index := NewIndex([]*database.Product{
+		{Pid: "1", Name: "Silver Drop Earrings"},
+		{Pid: "2", Name: "Gold Drop Earrings"},
+		{Pid: "3", Name: "Silver Koala Necklace"},
+		{Pid: "4", Name: "Gold Hoop Earrings"},
+		{Pid: "5", Name: "Justin Bieber Pillowcase"},
+		{Pid: "6", Name: "Silver Drop Earrings"},
+	})
+
+	tests := []struct {
+		name string
+		pid  string
+		n    int
+		want []string
+	}{
+		// the same name is most similar, then sharing the rarer drop beats sharing silver
+		{"ordered", "1", 10, []string{"6", "2", "3", "4"}},
+		{"cut to n", "1", 2, []string{"6", "2"}},
+		{"nothing in common", "5", 10, []string{}},
+		{"unknown", "9", 10, []string{}},
+	}
+
+	for _, test := range tests {
+		matches := index.Similar(test.pid, test.n)
+		got := make([]string, 0)
+		for _, m := range matches {
+			got = append(got, m.Product.Pid)
+			if m.Score <= 0.0 || m.Score > 1.0+1e-9 {
+				t.Errorf("%s: %s scored %f", test.name, m.Product.Pid, m.Score)
+			}
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	if matches := index.Similar("1", 1); len(matches) != 1 ||
+		math.Abs(matches[0].Score-1.0) > 1e-9 {
+		t.Errorf("an identical name doesn't score 1: %v", matches)
+	}
+}